@@ -0,0 +1,205 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// adminConsole serves the admin console of a guestbook, which lists the
+// newest greetings (or those matching the "q" query parameter) whatever
+// their status, and lets an administrator hide or delete them and replace
+// the guestbook's banner.
+func (app *application) adminConsole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var data struct {
+		Title     string
+		Prefix    string
+		User      string
+		Query     string
+		Message   string
+		Greetings []greeting
+	}
+	data.Title = app.title()
+	data.Prefix = bookPath(app.bookName())
+	data.User = adminUser(r)
+	data.Query = r.FormValue("q")
+	data.Message = r.FormValue("msg")
+	var err error
+	data.Greetings, err = app.store.search(r.Context(), data.Query, greetingsPerPage)
+	if err != nil {
+		log.Println("admin store error:", err)
+		http.Error(w, "could not load greetings", http.StatusInternalServerError)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err := adminTmpl.Execute(buf, data); err != nil {
+		log.Println("template error:", err)
+		http.Error(w, "could not render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Println("writing response:", err)
+	}
+}
+
+// adminGreeting handles the admin console's hide, unhide and delete buttons.
+func (app *application) adminGreeting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	id := r.FormValue("id")
+	action := r.FormValue("action")
+	var err error
+	switch action {
+	case "hide":
+		_, err = app.store.setStatus(ctx, id, statusApproved, statusHidden)
+	case "unhide":
+		_, err = app.store.setStatus(ctx, id, statusHidden, statusApproved)
+	case "delete":
+		var g *greeting
+		if g, err = app.store.delete(ctx, id); err == nil && g.Attachment != "" {
+			app.deleteAttachment(ctx, g.Attachment)
+		}
+	default:
+		http.Error(w, "action must be hide, unhide or delete", http.StatusBadRequest)
+		return
+	}
+	if err == errGreetingNotFound {
+		http.Error(w, "no such greeting, or it can't be "+action+"d", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("admin store error:", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	app.audit.record(ctx, &auditEntry{User: adminUser(r), Action: action + " greeting", Book: app.bookName(), Target: id})
+	app.redirectToConsole(w, r, "Greeting "+action+"d.")
+}
+
+// adminBanner handles the admin console's banner upload form.
+func (app *application) adminBanner(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+64<<10)
+	f, _, err := r.FormFile("banner")
+	if err != nil {
+		http.Error(w, "missing banner: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	_, err = app.replaceBanner(r.Context(), f)
+	switch err {
+	case nil:
+	case errAttachmentTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errBannerType:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	default:
+		log.Println("replacing banner:", err)
+		http.Error(w, "could not save banner", http.StatusInternalServerError)
+		return
+	}
+	app.audit.record(r.Context(), &auditEntry{User: adminUser(r), Action: "replace banner", Book: app.bookName()})
+	app.redirectToConsole(w, r, "Banner replaced.")
+}
+
+// redirectToConsole redirects back to the admin console after an action,
+// keeping the search and showing msg.
+func (app *application) redirectToConsole(w http.ResponseWriter, r *http.Request, msg string) {
+	q := url.Values{"msg": {msg}}
+	if s := r.FormValue("q"); s != "" {
+		q.Set("q", s)
+	}
+	http.Redirect(w, r, bookPath(app.bookName())+"/admin?"+q.Encode(), http.StatusSeeOther)
+}
+
+var adminTmpl = template.Must(template.New("admin.html").Parse(`<!DOCTYPE html>
+<title>{{.Title}} - Admin</title>
+<style type="text/css">
+html, body {
+	font-family: Helvetica, sans-serif;
+}
+blockquote {
+	font-family: cursive, Helvetica, sans-serif;
+}
+.attachment {
+	max-height: 200px;
+	max-width: 300px;
+}
+.message {
+	color: green;
+}
+.status {
+	font-weight: bold;
+}
+form.inline {
+	display: inline;
+}
+</style>
+<h1>{{.Title}} admin</h1>
+<p>
+	Signed in as {{.User}}.
+	<a href="{{.Prefix}}/">Guestbook</a> |
+	<a href="{{.Prefix}}/admin/moderate">Moderation</a> |
+	<a href="/admin/audit">Audit trail</a>
+	<form class="inline" action="/admin/logout" method="POST"><button type="submit">Sign out</button></form>
+</p>
+{{with .Message}}<p class="message">{{.}}</p>{{end}}
+<form action="{{.Prefix}}/admin/banner" method="POST" enctype="multipart/form-data">
+	<label>Replace banner <input type="file" name="banner" accept="image/gif,image/jpeg,image/png,image/webp"></label>
+	<input type="submit" value="Upload">
+</form>
+<form action="{{.Prefix}}/admin" method="GET">
+	<input name="q" value="{{.Query}}" placeholder="Search greetings">
+	<input type="submit" value="Search">
+</form>
+{{range .Greetings}}
+<div class="greeting">
+	<span class="status">{{.Status}}</span> {{.PostDate.Format "2006-01-02 15:04"}}:
+	<blockquote>{{.Content}}</blockquote>
+	{{with .Attachment}}<img class="attachment" src="{{$.Prefix}}/blob/{{.}}">{{end}}
+	<form action="{{$.Prefix}}/admin/greetings" method="POST">
+		<input type="hidden" name="id" value="{{.ID}}">
+		<input type="hidden" name="q" value="{{$.Query}}">
+		{{if eq .Status "approved"}}<button type="submit" name="action" value="hide">Hide</button>{{end}}
+		{{if eq .Status "hidden"}}<button type="submit" name="action" value="unhide">Unhide</button>{{end}}
+		<button type="submit" name="action" value="delete" onclick="return confirm('Delete this greeting?')">Delete</button>
+	</form>
+</div>
+{{else}}
+<p>No greetings found.</p>
+{{end}}
+`))
@@ -0,0 +1,360 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/runtimevar/constantvar"
+	"gocloud.dev/secrets/localsecrets"
+)
+
+// testAdminAuth returns an adminAuth admitting user "admin" with password
+// "hunter2", with the credentials encrypted the way an operator would.
+func testAdminAuth(t *testing.T) *adminAuth {
+	t.Helper()
+	ctx := context.Background()
+	key, err := localsecrets.NewRandomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeperURL := "base64key://" + base64.URLEncoding.EncodeToString(key[:])
+	var encrypted bytes.Buffer
+	if err := encryptAdminCredentials(ctx, keeperURL, strings.NewReader(`{"users": {"admin": "hunter2"}}`), &encrypted); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "admin.txt")
+	if err := os.WriteFile(path, encrypted.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, cleanup, err := openAdminAuth(ctx, &cliFlags{
+		adminVarURL:    "file://" + filepath.ToSlash(path),
+		adminKeeperURL: keeperURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	return auth
+}
+
+func TestAdminAuth(t *testing.T) {
+	if _, _, err := openAdminAuth(context.Background(), &cliFlags{adminVarURL: "constant://?val=x"}); err == nil {
+		t.Error("openAdminAuth without a keeper succeeded")
+	}
+
+	store, storeCleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storeCleanup()
+	router := newRouter(newApplication(store, nil, nil, nil, nil, nil, nil, testAdminAuth(t), nil, nil, nil, nil, ""))
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// Unauthenticated requests are refused, and browsers are sent to sign in.
+	r := httptest.NewRequest("GET", "/admin?q=x", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	if w := do(r); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("GET /admin without credentials: got status %d, WWW-Authenticate %q; want %d and a challenge", w.Code, w.Header().Get("WWW-Authenticate"), http.StatusUnauthorized)
+	}
+	r = httptest.NewRequest("GET", "/admin?q=x", nil)
+	r.Header.Set("Accept", "text/html")
+	if w := do(r); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/login?next=%2Fadmin%3Fq%3Dx" {
+		t.Errorf("GET /admin from a browser: got status %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// Basic authentication.
+	for _, test := range []struct {
+		user, password string
+		want           int
+	}{
+		{"admin", "hunter2", http.StatusOK},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{"nobody", "hunter2", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/admin", nil)
+		r.SetBasicAuth(test.user, test.password)
+		if w := do(r); w.Code != test.want {
+			t.Errorf("GET /admin as %s:%s: got status %d, want %d", test.user, test.password, w.Code, test.want)
+		}
+	}
+
+	// Signing in with the form.
+	login := func(user, password string) *httptest.ResponseRecorder {
+		form := url.Values{"user": {user}, "password": {password}, "next": {"/admin?q=x"}}
+		r := httptest.NewRequest("POST", "/admin/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return do(r)
+	}
+	if w := login("admin", "wrong"); w.Code != http.StatusUnauthorized || len(w.Result().Cookies()) != 0 {
+		t.Errorf("sign in with wrong password: got status %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+	w := login("admin", "hunter2")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin?q=x" {
+		t.Fatalf("sign in: got status %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("sign in: got cookies %v, want one HttpOnly %s cookie", cookies, sessionCookie)
+	}
+	session := cookies[0]
+	r = httptest.NewRequest("GET", "/admin", nil)
+	r.AddCookie(session)
+	if w := do(r); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Signed in as admin") {
+		t.Errorf("GET /admin with session: got status %d:\n%s", w.Code, w.Body)
+	}
+	forged := *session
+	forged.Value = base64.RawURLEncoding.EncodeToString([]byte("admin|99999999999")) + forged.Value[strings.Index(forged.Value, "."):]
+	r = httptest.NewRequest("GET", "/admin", nil)
+	r.AddCookie(&forged)
+	if w := do(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /admin with forged session: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Redirects after signing in stay on this site.
+	form := url.Values{"user": {"admin"}, "password": {"hunter2"}, "next": {"//evil.example/"}}
+	r = httptest.NewRequest("POST", "/admin/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := do(r); w.Header().Get("Location") != "/admin" {
+		t.Errorf("sign in with next=//evil.example/: redirected to %q", w.Header().Get("Location"))
+	}
+}
+
+func TestAdminWithoutCredentials(t *testing.T) {
+	for _, test := range []struct {
+		admin        *adminAuth
+		remoteAddr   string
+		forwardedFor string
+		want         int
+	}{
+		{nil, "127.0.0.1:1234", "", http.StatusForbidden},
+		{&adminAuth{}, "127.0.0.1:1234", "", http.StatusOK},
+		{&adminAuth{}, "[::1]:1234", "", http.StatusOK},
+		{&adminAuth{}, "192.0.2.1:1234", "", http.StatusForbidden},
+		{&adminAuth{}, "127.0.0.1:1234", "192.0.2.1", http.StatusForbidden},
+	} {
+		router := newRouter(newApplication(nil, nil, nil, nil, nil, nil, nil, test.admin, nil, nil, nil, nil, ""))
+		r := httptest.NewRequest("GET", "/admin/audit", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("GET /admin/audit from %s (forwarded for %q, local admin %t): got status %d, want %d", test.remoteAddr, test.forwardedFor, test.admin != nil, w.Code, test.want)
+		}
+		// Without -audit_bucket, the page says where the audit trail went.
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "-audit_bucket") {
+			t.Errorf("GET /admin/audit without an audit bucket:\n%s", w.Body)
+		}
+	}
+}
+
+func TestAdminCrossSite(t *testing.T) {
+	store, storeCleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storeCleanup()
+	ctx := context.Background()
+	router := newRouter(newApplication(store, nil, nil, nil, nil, nil, nil, &adminAuth{}, nil, nil, nil, nil, ""))
+	for _, test := range []struct {
+		header, value string
+		want          int
+	}{
+		{"Origin", "http://evil.example", http.StatusForbidden},
+		{"Origin", "null", http.StatusForbidden},
+		{"Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"Sec-Fetch-Site", "same-site", http.StatusForbidden},
+		{"Origin", "http://example.com", http.StatusSeeOther},
+		{"Sec-Fetch-Site", "same-origin", http.StatusSeeOther},
+		{"", "", http.StatusSeeOther}, // scripts, such as curl
+	} {
+		g := &greeting{Content: "Delete me"}
+		if err := store.add(ctx, g); err != nil {
+			t.Fatal(err)
+		}
+		form := url.Values{"id": {g.ID}, "action": {"delete"}}
+		r := httptest.NewRequest("POST", "/admin/greetings", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "127.0.0.1:1234"
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("POST /admin/greetings with %s: %s: got status %d, want %d: %s", test.header, test.value, w.Code, test.want, w.Body)
+		}
+	}
+}
+
+func TestAdminConsole(t *testing.T) {
+	ctx := context.Background()
+	store, storeCleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storeCleanup()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	motd := constantvar.New("")
+	defer motd.Close()
+	auditBucket := memblob.OpenBucket(nil)
+	defer auditBucket.Close()
+	audit := newAuditLog(auditBucket)
+	app := newApplication(store, bucket, motd, nil, nil, nil, nil, testAdminAuth(t), audit, nil, nil, nil, "")
+	router := newRouter(app)
+	do := func(method, target, contentType string, body *bytes.Buffer) *httptest.ResponseRecorder {
+		t.Helper()
+		if body == nil {
+			body = new(bytes.Buffer)
+		}
+		r := httptest.NewRequest(method, target, body)
+		r.SetBasicAuth("admin", "hunter2")
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	act := func(id, action string) int {
+		t.Helper()
+		form := url.Values{"id": {id}, "action": {action}, "q": {"gopher"}}
+		w := do("POST", "/admin/greetings", "application/x-www-form-urlencoded", bytes.NewBufferString(form.Encode()))
+		if w.Code == http.StatusSeeOther && !strings.Contains(w.Header().Get("Location"), "q=gopher") {
+			t.Errorf("%s: redirected to %q, which loses the search", action, w.Header().Get("Location"))
+		}
+		return w.Code
+	}
+
+	if err := bucket.WriteAll(ctx, "attachments/a.png", []byte("image"), nil); err != nil {
+		t.Fatal(err)
+	}
+	greetings := []*greeting{
+		{Content: "Hello, Gophers!", Attachment: "attachments/a.png"},
+		{Content: "Hi there"},
+		{Content: "A gopher was here", Status: statusPending},
+	}
+	for _, g := range greetings {
+		if err := store.add(ctx, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Searching finds greetings whatever their status.
+	body := do("GET", "/admin?q=GOPHER", "", nil).Body.String()
+	if !strings.Contains(body, "Hello, Gophers!") || !strings.Contains(body, "A gopher was here") || strings.Contains(body, "Hi there") {
+		t.Errorf("search for GOPHER: got\n%s", body)
+	}
+
+	// Hiding and unhiding.
+	if code := act(greetings[1].ID, "hide"); code != http.StatusSeeOther {
+		t.Fatalf("hide: got status %d, want %d", code, http.StatusSeeOther)
+	}
+	if body := do("GET", "/", "", nil).Body.String(); strings.Contains(body, "Hi there") {
+		t.Error("hidden greeting is shown on the index page")
+	}
+	if code := act(greetings[1].ID, "hide"); code != http.StatusNotFound {
+		t.Errorf("hide twice: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := act(greetings[2].ID, "hide"); code != http.StatusNotFound {
+		t.Errorf("hide pending greeting: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := act(greetings[1].ID, "unhide"); code != http.StatusSeeOther {
+		t.Errorf("unhide: got status %d, want %d", code, http.StatusSeeOther)
+	}
+	if body := do("GET", "/", "", nil).Body.String(); !strings.Contains(body, "Hi there") {
+		t.Error("unhidden greeting is not shown on the index page")
+	}
+
+	// Deleting also deletes the attachment.
+	if code := act(greetings[0].ID, "delete"); code != http.StatusSeeOther {
+		t.Fatalf("delete: got status %d, want %d", code, http.StatusSeeOther)
+	}
+	if code := act(greetings[0].ID, "delete"); code != http.StatusNotFound {
+		t.Errorf("delete twice: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if ok, err := bucket.Exists(ctx, "attachments/a.png"); err != nil || ok {
+		t.Errorf("attachment of deleted greeting: Exists = %t, %v", ok, err)
+	}
+	if code := act(greetings[1].ID, "shred"); code != http.StatusBadRequest {
+		t.Errorf("unknown action: got status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// Replacing the banner.
+	banner, err := os.ReadFile(filepath.Join("blobs", "gophers.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := new(bytes.Buffer)
+	mw := multipart.NewWriter(upload)
+	fw, err := mw.CreateFormFile("banner", "banner.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(banner)
+	mw.Close()
+	if w := do("POST", "/admin/banner", mw.FormDataContentType(), upload); w.Code != http.StatusSeeOther {
+		t.Fatalf("upload banner: got status %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	_, key := envBanner()
+	if got, err := bucket.ReadAll(ctx, key); err != nil || !bytes.Equal(got, banner) {
+		t.Errorf("banner %s was not replaced (%v)", key, err)
+	}
+
+	// Every action is in the audit trail, newest first.
+	entries, err := audit.recent(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		if e.User != "admin" {
+			t.Errorf("audit entry %+v: got user %q, want admin", e, e.User)
+		}
+		got = append(got, e.Action)
+	}
+	want := []string{"replace banner", "delete greeting", "unhide greeting", "hide greeting"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("audit trail: got %q, want %q", got, want)
+	}
+	if body := do("GET", "/admin/audit", "", nil).Body.String(); !strings.Contains(body, greetings[0].ID) {
+		t.Errorf("audit page does not show the deleted greeting:\n%s", body)
+	}
+	// None of it is in the bucket that is served to visitors.
+	if obj, err := bucket.List(&blob.ListOptions{Prefix: auditPrefix}).Next(ctx); err != io.EOF {
+		t.Errorf("audit trail is in the guestbook's bucket: got %+v, %v", obj, err)
+	}
+}
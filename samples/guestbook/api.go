@@ -0,0 +1,225 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gocloud.dev/gcerrors"
+)
+
+// This file implements a JSON REST API for greetings under /api/v1:
+//
+//	GET  /api/v1/greetings?before=CURSOR&after=CURSOR&limit=N
+//	POST /api/v1/greetings  {"content": "Hello!"}
+//
+// In moderation mode, POST responds with 202 Accepted and a greeting whose
+// status is "pending". Other guestbooks serve the same API under
+// /g/{book}/api/v1.
+//
+// Errors are returned as {"error": {"code": CODE, "message": MESSAGE}}, where
+// CODE is the name of a gocloud.dev/gcerrors.ErrorCode, such as
+// "InvalidArgument".
+
+// maxAPIRequestSize is the largest request body, in bytes, accepted by the API.
+const maxAPIRequestSize = 64 << 10
+
+// apiGreeting is the JSON representation of a greeting.
+type apiGreeting struct {
+	ID            string    `json:"id"`
+	Book          string    `json:"book,omitempty"`
+	Content       string    `json:"content"`
+	PostDate      time.Time `json:"post_date"`
+	AttachmentURL string    `json:"attachment_url,omitempty"`
+	Status        string    `json:"status"`
+	Likes         int64     `json:"likes"`
+}
+
+func newAPIGreeting(g *greeting) apiGreeting {
+	ag := apiGreeting{ID: g.ID, Book: g.Book, Content: g.Content, PostDate: g.PostDate, Status: g.Status, Likes: g.Likes}
+	if ag.Status == "" {
+		ag.Status = statusApproved
+	}
+	if g.Attachment != "" {
+		ag.AttachmentURL = bookPath(g.Book) + "/blob/" + g.Attachment
+	}
+	return ag
+}
+
+// apiGreetingPage is the response to GET /api/v1/greetings. Older and Newer
+// are cursors to pass as the before and after parameters to fetch the
+// adjacent pages.
+type apiGreetingPage struct {
+	Greetings []apiGreeting `json:"greetings"`
+	Older     string        `json:"older,omitempty"`
+	Newer     string        `json:"newer,omitempty"`
+}
+
+// apiNewGreeting is the request body of POST /api/v1/greetings.
+type apiNewGreeting struct {
+	Content string `json:"content"`
+}
+
+// apiError is the body of an error response.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiErrorStatus maps error codes to HTTP status codes. Codes not listed map
+// to 500 Internal Server Error.
+var apiErrorStatus = map[gcerrors.ErrorCode]int{
+	gcerrors.NotFound:           http.StatusNotFound,
+	gcerrors.AlreadyExists:      http.StatusConflict,
+	gcerrors.InvalidArgument:    http.StatusBadRequest,
+	gcerrors.FailedPrecondition: http.StatusPreconditionFailed,
+	gcerrors.PermissionDenied:   http.StatusForbidden,
+	gcerrors.ResourceExhausted:  http.StatusTooManyRequests,
+	gcerrors.Unimplemented:      http.StatusNotImplemented,
+	gcerrors.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// apiGreetings handles /api/v1/greetings.
+func (app *application) apiGreetings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		app.apiListGreetings(w, r)
+	case "POST":
+		if wait := app.limiter.allow(r, actionSign); wait > 0 {
+			setRetryAfter(w, wait)
+			writeAPIError(w, gcerrors.ResourceExhausted, "too many greetings from this client; retry later")
+			return
+		}
+		app.apiCreateGreeting(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIJSON(w, http.StatusMethodNotAllowed, &apiError{Error: apiErrorDetail{
+			Code:    gcerrors.Unimplemented.String(),
+			Message: "only GET and POST allowed",
+		}})
+	}
+}
+
+// apiListGreetings returns a page of greetings, oldest first.
+func (app *application) apiListGreetings(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := greetingsPerPage
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > greetingsPerPage {
+			writeAPIError(w, gcerrors.InvalidArgument, "limit must be between 1 and "+strconv.Itoa(greetingsPerPage))
+			return
+		}
+		limit = n
+	}
+	p, err := loadPage(r.Context(), app.store, q.Get("before"), q.Get("after"), limit)
+	if err == errBadCursor {
+		writeAPIError(w, gcerrors.InvalidArgument, "invalid page cursor")
+		return
+	}
+	if err != nil {
+		log.Println("api list store error:", err)
+		writeAPIError(w, gcerrors.Code(err), "could not load greetings")
+		return
+	}
+	resp := &apiGreetingPage{
+		Greetings: make([]apiGreeting, 0, len(p.Greetings)),
+		Older:     p.Older,
+		Newer:     p.Newer,
+	}
+	for i := range p.Greetings {
+		resp.Greetings = append(resp.Greetings, newAPIGreeting(&p.Greetings[i]))
+	}
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+// apiCreateGreeting adds a greeting and returns it.
+func (app *application) apiCreateGreeting(w http.ResponseWriter, r *http.Request) {
+	var req apiNewGreeting
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeAPIJSON(w, http.StatusRequestEntityTooLarge, &apiError{Error: apiErrorDetail{
+				Code:    gcerrors.InvalidArgument.String(),
+				Message: "request body too large",
+			}})
+			return
+		}
+		writeAPIError(w, gcerrors.InvalidArgument, "malformed JSON request: "+err.Error())
+		return
+	}
+	if err := app.checkContent(r.Context(), req.Content); err != nil {
+		var cerr *contentError
+		if errors.As(err, &cerr) {
+			writeAPIError(w, gcerrors.InvalidArgument, err.Error())
+		} else {
+			log.Println("api content policy error:", err)
+			writeAPIJSON(w, http.StatusServiceUnavailable, &apiError{Error: apiErrorDetail{
+				Code:    gcerrors.Code(err).String(),
+				Message: "content policy unavailable",
+			}})
+		}
+		return
+	}
+	g := &greeting{Content: req.Content}
+	if err := app.addGreeting(r.Context(), g); err != nil {
+		log.Println("api create store error:", err)
+		writeAPIError(w, gcerrors.Code(err), "could not save greeting")
+		return
+	}
+	status := http.StatusCreated
+	if g.Status == statusPending {
+		// The greeting is not visible until a moderator approves it.
+		status = http.StatusAccepted
+	}
+	writeAPIJSON(w, status, newAPIGreeting(g))
+}
+
+// writeAPIError writes an error response with the HTTP status for code.
+func writeAPIError(w http.ResponseWriter, code gcerrors.ErrorCode, msg string) {
+	status, ok := apiErrorStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeAPIJSON(w, status, &apiError{Error: apiErrorDetail{Code: code.String(), Message: msg}})
+}
+
+// writeAPIJSON writes v as the JSON body of a response with the given status.
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		log.Println("api encoding error:", err)
+		http.Error(w, "could not encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Println("writing response:", err)
+	}
+}
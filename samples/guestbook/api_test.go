@@ -0,0 +1,84 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// apiDo sends a request to the API and decodes the JSON response into v.
+func apiDo(t *testing.T, method, path, body string, v interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, memBase+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("%s %s: got Content-Type %q, want JSON", method, path, ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%s %s: decoding response: %v", method, path, err)
+	}
+	return resp
+}
+
+func TestAPI(t *testing.T) {
+	var created apiGreeting
+	resp := apiDo(t, "POST", "/api/v1/greetings", `{"content": "Hello from the API"}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if created.ID == "" || created.Content != "Hello from the API" || created.PostDate.IsZero() {
+		t.Errorf("POST: got %+v, want a greeting with ID, content and post date", created)
+	}
+
+	var list apiGreetingPage
+	resp = apiDo(t, "GET", "/api/v1/greetings?limit=1", "", &list)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if len(list.Greetings) != 1 || list.Greetings[0].ID != created.ID {
+		t.Errorf("GET: got %+v, want only the newest greeting %q", list.Greetings, created.ID)
+	}
+
+	for _, test := range []struct {
+		method, path, body string
+		wantStatus         int
+		wantCode           string
+	}{
+		{"POST", "/api/v1/greetings", `{"content": ""}`, http.StatusBadRequest, "InvalidArgument"},
+		{"POST", "/api/v1/greetings", `{"content": "` + strings.Repeat("x", maxContentLength+1) + `"}`, http.StatusBadRequest, "InvalidArgument"},
+		{"POST", "/api/v1/greetings", `{"content": `, http.StatusBadRequest, "InvalidArgument"},
+		{"POST", "/api/v1/greetings", `{"text": "hi"}`, http.StatusBadRequest, "InvalidArgument"},
+		{"GET", "/api/v1/greetings?before=bogus", "", http.StatusBadRequest, "InvalidArgument"},
+		{"GET", "/api/v1/greetings?limit=0", "", http.StatusBadRequest, "InvalidArgument"},
+		{"DELETE", "/api/v1/greetings", "", http.StatusMethodNotAllowed, "Unimplemented"},
+	} {
+		var got apiError
+		resp := apiDo(t, test.method, test.path, test.body, &got)
+		if resp.StatusCode != test.wantStatus || got.Error.Code != test.wantCode {
+			t.Errorf("%s %s %q: got status %d, code %q; want %d, %q", test.method, test.path, test.body, resp.StatusCode, got.Error.Code, test.wantStatus, test.wantCode)
+		}
+	}
+}
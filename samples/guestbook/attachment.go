@@ -0,0 +1,108 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// maxAttachmentSize is the largest image, in bytes, that may be attached to a
+// greeting.
+const maxAttachmentSize = 2 << 20
+
+// attachmentPrefix is the bucket prefix under which attachments are stored.
+const attachmentPrefix = "attachments/"
+
+// attachmentTypes maps the content types accepted for attachments to the
+// extension of the blob key they are stored under.
+var attachmentTypes = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+var (
+	errAttachmentTooLarge = errors.New("attachment is too large")
+	errAttachmentType     = errors.New("attachment must be a GIF, JPEG, PNG or WebP image")
+)
+
+// saveAttachment copies an uploaded image from r into the bucket and returns
+// its key. The content type is sniffed from the data rather than trusted from
+// the upload. saveAttachment returns errAttachmentTooLarge or
+// errAttachmentType if the upload is rejected.
+func saveAttachment(ctx context.Context, bucket *blob.Bucket, r io.Reader) (key string, err error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return "", errAttachmentType
+		}
+		return "", err
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	ext, ok := attachmentTypes[contentType]
+	if !ok {
+		return "", errAttachmentType
+	}
+
+	key = attachmentPrefix + uuid.NewString() + ext
+	// Cancel the write if anything goes wrong, so that no partial blob is
+	// left behind.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Attachment keys are never reused, so caches may keep them forever.
+	w, err := bucket.NewWriter(ctx, key, &blob.WriterOptions{
+		ContentType:  contentType,
+		CacheControl: "public, max-age=31536000, immutable",
+	})
+	if err != nil {
+		return "", err
+	}
+	// Read one byte past the limit to detect oversized uploads.
+	body := io.LimitReader(io.MultiReader(bytes.NewReader(head), r), maxAttachmentSize+1)
+	written, err := io.Copy(w, body)
+	if err == nil && written > maxAttachmentSize {
+		err = errAttachmentTooLarge
+	}
+	if err != nil {
+		cancel()
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// deleteAttachment deletes the attachment of a greeting that has been deleted
+// or rejected. Failures are only logged: the attachment is then left behind,
+// but it can only be reached by its unguessable key.
+func (app *application) deleteAttachment(ctx context.Context, key string) {
+	if err := app.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		log.Printf("deleting attachment %s: %v", key, err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+// auditPrefix is the bucket prefix under which the audit trail is kept, so
+// that -audit_bucket can be shared with -backup_bucket.
+const auditPrefix = "audit/"
+
+// An auditEntry records an action taken by an administrator.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Action string    `json:"action"`
+	Book   string    `json:"book,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// An auditLog is the audit trail of administrator actions. Each entry is
+// kept in its own blob, keyed so that listing the bucket returns the newest
+// entries first. A nil *auditLog only writes entries to the server log.
+type auditLog struct {
+	bucket *blob.Bucket
+}
+
+// newAuditLog returns an audit log kept in bucket.
+func newAuditLog(bucket *blob.Bucket) *auditLog {
+	return &auditLog{bucket: bucket}
+}
+
+// openAuditLog is a Wire provider function that returns the audit log kept in
+// the bucket at -audit_bucket. The guestbook's own bucket is served to
+// visitors, so the audit trail is never kept there; if the flag is empty,
+// admin actions are only written to the server log.
+func openAuditLog(ctx context.Context, flags *cliFlags) (*auditLog, func(), error) {
+	if flags.auditBucketURL == "" {
+		return nil, func() {}, nil
+	}
+	b, err := blob.OpenBucket(ctx, flags.auditBucketURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening -audit_bucket: %v", err)
+	}
+	return newAuditLog(b), func() { b.Close() }, nil
+}
+
+// auditKey returns the key for an entry recorded at t. Keys sort in reverse
+// chronological order; the random suffix keeps entries recorded at the same
+// time apart.
+func auditKey(t time.Time) (string, error) {
+	var suffix [4]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%019d-%s.json", auditPrefix, math.MaxInt64-t.UnixNano(), hex.EncodeToString(suffix[:])), nil
+}
+
+// record adds e to the audit trail, setting its time. Failures are logged,
+// and the entry is always written to the server log as well, so that it is
+// not lost if the bucket is unavailable.
+func (l *auditLog) record(ctx context.Context, e *auditEntry) {
+	e.Time = time.Now().UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println("audit:", err)
+		return
+	}
+	log.Printf("audit: %s", data)
+	if l == nil {
+		return
+	}
+	key, err := auditKey(e.Time)
+	if err == nil {
+		err = l.bucket.WriteAll(ctx, key, data, &blob.WriterOptions{ContentType: "application/json"})
+	}
+	if err != nil {
+		log.Println("recording audit entry:", err)
+	}
+}
+
+// recent returns up to n of the most recent entries, newest first.
+func (l *auditLog) recent(ctx context.Context, n int) ([]*auditEntry, error) {
+	var entries []*auditEntry
+	if l == nil {
+		return entries, nil
+	}
+	iter := l.bucket.List(&blob.ListOptions{Prefix: auditPrefix})
+	for len(entries) < n {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := l.bucket.ReadAll(ctx, obj.Key)
+		if err != nil {
+			return nil, err
+		}
+		e := new(auditEntry)
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("parsing audit entry %s: %v", obj.Key, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// auditSize is the number of entries shown on the audit page.
+const auditSize = 100
+
+// auditPage serves the most recent entries of the audit trail.
+func (app *application) auditPage(w http.ResponseWriter, r *http.Request) {
+	entries, err := app.audit.recent(r.Context(), auditSize)
+	if err != nil {
+		log.Println("reading audit trail:", err)
+		http.Error(w, "could not read audit trail", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Kept    bool
+		Entries []*auditEntry
+	}{app.audit != nil, entries}
+	if err := auditTmpl.Execute(w, data); err != nil {
+		log.Println("template error:", err)
+	}
+}
+
+var auditTmpl = template.Must(template.New("audit.html").Parse(`<!DOCTYPE html>
+<title>Guestbook - Audit trail</title>
+<style type="text/css">
+html, body {
+	font-family: Helvetica, sans-serif;
+}
+td, th {
+	padding: 0.2em 0.6em;
+	text-align: left;
+}
+</style>
+<h1>Audit trail</h1>
+<p><a href="/admin">Back to the admin console</a></p>
+{{if not .Kept}}
+<p>The audit trail is only written to the server log. Set -audit_bucket to keep it here.</p>
+{{else if .Entries}}
+<table>
+<tr><th>Time</th><th>User</th><th>Action</th><th>Guestbook</th><th>Target</th><th>Detail</th></tr>
+{{range .Entries}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.User}}</td><td>{{.Action}}</td><td>{{.Book}}</td><td>{{.Target}}</td><td>{{.Detail}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No admin actions have been recorded.</p>
+{{end}}
+`))
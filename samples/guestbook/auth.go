@@ -0,0 +1,465 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/secrets"
+	_ "gocloud.dev/secrets/awskms"
+	_ "gocloud.dev/secrets/azurekeyvault"
+	_ "gocloud.dev/secrets/gcpkms"
+	_ "gocloud.dev/secrets/localsecrets"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The admin pages (everything under /admin) are protected by the credentials
+// in the runtimevar named by -admin_var. The variable holds a JSON
+// adminCredentials, encrypted with the secrets.Keeper named by -admin_keeper
+// and base64-encoded; see encryptAdminCredentials. Administrators sign in
+// through /admin/login, which sets a signed session cookie, or use HTTP basic
+// authentication, which is handy for scripts.
+//
+// Without -admin_var, the admin pages are not served at all, unless
+// -insecure_local_admin is set for local development, in which case they are
+// served to every client on the loopback interface. That is not safe when
+// deployed: sidecar proxies also connect from loopback addresses.
+//
+// Requests that change data are refused if the browser says they come from
+// another site, so that other pages can't act through an administrator's
+// session or a local admin's browser.
+
+// sessionCookie is the name of the cookie holding an admin session.
+const sessionCookie = "guestbook_admin"
+
+// sessionDuration is how long an admin session lasts.
+const sessionDuration = 12 * time.Hour
+
+// localAdmin is the user name recorded for administrators on the loopback
+// interface with -insecure_local_admin.
+const localAdmin = "local"
+
+// adminCredentials are the credentials of the administrators.
+type adminCredentials struct {
+	// Users maps user names to bcrypt hashes of their passwords.
+	Users map[string]string `json:"users"`
+	// SessionKey is the key used to sign session cookies. If it is empty, a
+	// random key is used, so sessions don't survive restarts and only work
+	// with the server that signed them in.
+	SessionKey []byte `json:"session_key,omitempty"`
+}
+
+// An adminAuth authenticates administrators. An adminAuth without
+// credentials admits clients on the loopback interface. A nil *adminAuth
+// admits no one.
+type adminAuth struct {
+	creds *parsedVar[*adminCredentials] // nil for -insecure_local_admin
+}
+
+// openAdminAuth is a Wire provider function that opens the admin credentials
+// variable and keeper named by the command-line flags. It returns nil,
+// disabling the admin pages, if no credentials are configured and
+// -insecure_local_admin is not set.
+func openAdminAuth(ctx context.Context, flags *cliFlags) (*adminAuth, func(), error) {
+	if flags.adminVarURL == "" {
+		if flags.insecureLocalAdmin {
+			log.Println("-insecure_local_admin: admin pages are served to every client on the loopback interface")
+			return &adminAuth{}, func() {}, nil
+		}
+		log.Println("No -admin_var; admin pages are disabled")
+		return nil, func() {}, nil
+	}
+	if flags.adminKeeperURL == "" {
+		return nil, nil, errors.New("-admin_var requires -admin_keeper")
+	}
+	keeper, err := secrets.OpenKeeper(ctx, flags.adminKeeperURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := runtimevar.OpenVariable(ctx, flags.adminVarURL)
+	if err != nil {
+		keeper.Close()
+		return nil, nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		v.Close()
+		keeper.Close()
+		return nil, nil, err
+	}
+	parse := func(ctx context.Context, data []byte) (*adminCredentials, error) {
+		return decryptAdminCredentials(ctx, keeper, data, key)
+	}
+	a := &adminAuth{creds: newParsedVar(v, "admin credentials", parse)}
+	return a, func() {
+		v.Close()
+		keeper.Close()
+	}, nil
+}
+
+// credentials returns the current admin credentials.
+func (a *adminAuth) credentials(ctx context.Context) (*adminCredentials, error) {
+	return a.creds.get(ctx)
+}
+
+// decryptAdminCredentials decrypts admin credentials in the form produced by
+// encryptAdminCredentials with keeper. If they have no session key,
+// randomKey is used.
+func decryptAdminCredentials(ctx context.Context, keeper *secrets.Keeper, data, randomKey []byte) (*adminCredentials, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding admin credentials: %v", err)
+	}
+	plaintext, err := keeper.Decrypt(ctx, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting admin credentials: %v", err)
+	}
+	creds := new(adminCredentials)
+	if err := json.Unmarshal(plaintext, creds); err != nil {
+		return nil, fmt.Errorf("parsing admin credentials: %v", err)
+	}
+	if len(creds.SessionKey) == 0 {
+		creds.SessionKey = randomKey
+	}
+	return creds, nil
+}
+
+// dummyHash is compared against the passwords of unknown users, so that
+// signing in takes as long for them as for known users.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// checkPassword reports whether password is the password of user.
+func (c *adminCredentials) checkPassword(user, password string) bool {
+	hash, ok := c.Users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// newSession returns a session cookie value for user that expires at exp.
+func (c *adminCredentials) newSession(user string, exp time.Time) string {
+	payload := user + "|" + strconv.FormatInt(exp.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(c.sign(payload))
+}
+
+// checkSession returns the user of a session cookie value, if the value was
+// signed with c's key, has not expired, and names a current user.
+func (c *adminCredentials) checkSession(value string, now time.Time) (user string, ok bool) {
+	p, s, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !hmac.Equal(sig, c.sign(string(payload))) {
+		return "", false
+	}
+	user, expStr, ok := strings.Cut(string(payload), "|")
+	if !ok {
+		return "", false
+	}
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return "", false
+	}
+	if _, ok := c.Users[user]; !ok {
+		return "", false
+	}
+	return user, true
+}
+
+func (c *adminCredentials) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, c.SessionKey)
+	io.WriteString(mac, payload)
+	return mac.Sum(nil)
+}
+
+// authenticate returns the name of the administrator making r. If r is not
+// from an administrator, authenticate responds to it, by asking the client to
+// sign in if possible, and returns false.
+func (a *adminAuth) authenticate(w http.ResponseWriter, r *http.Request) (user string, ok bool) {
+	if a == nil {
+		http.Error(w, "admin pages are disabled; set -admin_var", http.StatusForbidden)
+		return "", false
+	}
+	if a.creds == nil {
+		if isLoopback(r) {
+			return localAdmin, true
+		}
+		http.Error(w, "admin pages are only served on the loopback interface", http.StatusForbidden)
+		return "", false
+	}
+	creds, err := a.credentials(r.Context())
+	if err != nil {
+		log.Println("loading admin credentials:", err)
+		http.Error(w, "admin credentials unavailable", http.StatusServiceUnavailable)
+		return "", false
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if user, ok := creds.checkSession(c.Value, time.Now()); ok {
+			return user, true
+		}
+	}
+	if user, password, ok := r.BasicAuth(); ok && creds.checkPassword(user, password) {
+		return user, true
+	}
+	if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return "", false
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="Guestbook admin", charset="UTF-8"`)
+	http.Error(w, "sign in required", http.StatusUnauthorized)
+	return "", false
+}
+
+// isLoopback reports whether r comes from the loopback interface. Requests
+// forwarded by a proxy are not, even if the proxy runs on the same host.
+func isLoopback(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isCrossSite reports whether the browser that sent r says it was sent by a
+// page of another site. Requests from scripts, which send neither
+// Sec-Fetch-Site nor Origin, are not.
+func isCrossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return false
+	case "":
+	default:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+// checkSameSite responds to requests that change data with 403 Forbidden if
+// they come from another site, and reports whether r may go on.
+func checkSameSite(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if isCrossSite(r) {
+		http.Error(w, "cross-site requests are not allowed", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adminUserKey is the context key for the name of the administrator making a
+// request.
+type adminUserKey struct{}
+
+// adminUser returns the name of the administrator making r.
+func adminUser(r *http.Request) string {
+	user, _ := r.Context().Value(adminUserKey{}).(string)
+	return user
+}
+
+// adminOnly returns a handler that calls h only for requests from
+// administrators.
+func adminOnly(h bookHandler) bookHandler {
+	return func(app *application, w http.ResponseWriter, r *http.Request) {
+		if !checkSameSite(w, r) {
+			return
+		}
+		user, ok := app.admin.authenticate(w, r)
+		if !ok {
+			return
+		}
+		h(app, w, r.WithContext(context.WithValue(r.Context(), adminUserKey{}, user)))
+	}
+}
+
+// login serves the admin sign-in page.
+func (app *application) login(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/admin"
+	}
+	data := struct {
+		Next    string
+		Enabled bool
+		Local   bool
+		Error   string
+	}{Next: next, Enabled: app.admin != nil && app.admin.creds != nil, Local: app.admin != nil && app.admin.creds == nil}
+	if !checkSameSite(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !data.Enabled {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		creds, err := app.admin.credentials(r.Context())
+		if err != nil {
+			log.Println("loading admin credentials:", err)
+			http.Error(w, "admin credentials unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		user := r.FormValue("user")
+		if creds.checkPassword(user, r.FormValue("password")) {
+			exp := time.Now().Add(sessionDuration)
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    creds.newSession(user, exp),
+				Path:     "/",
+				Expires:  exp,
+				HttpOnly: true,
+				Secure:   strings.HasPrefix(baseURL(r), "https:"),
+				SameSite: http.SameSiteStrictMode,
+			})
+			app.audit.record(r.Context(), &auditEntry{User: user, Action: "login"})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("failed admin sign-in for %q from %s", user, r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		data.Error = "Wrong user name or password."
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Only GET and POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := loginTmpl.Execute(w, data); err != nil {
+		log.Println("template error:", err)
+	}
+}
+
+// logout ends an admin session.
+func (app *application) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkSameSite(w, r) {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+var loginTmpl = template.Must(template.New("login.html").Parse(`<!DOCTYPE html>
+<title>Guestbook - Sign in</title>
+<style type="text/css">
+html, body {
+	font-family: Helvetica, sans-serif;
+}
+.error {
+	color: red;
+}
+</style>
+<h1>Sign in</h1>
+{{if .Enabled}}
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+<form action="/admin/login" method="POST">
+	<input type="hidden" name="next" value="{{.Next}}">
+	<div><label>User <input name="user" autocomplete="username"></label></div>
+	<div><label>Password <input type="password" name="password" autocomplete="current-password"></label></div>
+	<div><input type="submit" value="Sign in"></div>
+</form>
+{{else if .Local}}
+<p>No admin credentials are configured, so the <a href="{{.Next}}">admin pages</a> are open to local clients.</p>
+{{else}}
+<p>No admin credentials are configured, so the admin pages are disabled.</p>
+{{end}}
+`))
+
+// encryptAdminCredentials reads admin credentials in JSON from r, encrypts
+// them with the keeper at keeperURL, and writes them to w in the form
+// expected in the -admin_var variable. Passwords that are not already bcrypt
+// hashes are hashed, and a session key is generated if there is none.
+func encryptAdminCredentials(ctx context.Context, keeperURL string, r io.Reader, w io.Writer) error {
+	creds := new(adminCredentials)
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(creds); err != nil {
+		return fmt.Errorf("parsing admin credentials: %v", err)
+	}
+	if len(creds.Users) == 0 {
+		return errors.New("admin credentials have no users")
+	}
+	for user, password := range creds.Users {
+		if _, err := bcrypt.Cost([]byte(password)); err == nil {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("hashing password of %q: %v", user, err)
+		}
+		creds.Users[user] = string(hash)
+	}
+	if len(creds.SessionKey) == 0 {
+		creds.SessionKey = make([]byte, 32)
+		if _, err := rand.Read(creds.SessionKey); err != nil {
+			return err
+		}
+	}
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	keeper, err := secrets.OpenKeeper(ctx, keeperURL)
+	if err != nil {
+		return err
+	}
+	defer keeper.Close()
+	ciphertext, err := keeper.Encrypt(ctx, plaintext)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, base64.StdEncoding.EncodeToString(ciphertext))
+	return err
+}
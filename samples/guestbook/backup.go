@@ -0,0 +1,332 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/secrets"
+	"gocloud.dev/secrets/localsecrets"
+)
+
+// This file implements backups of the greetings of all guestbooks. A backup
+// is a gzip-compressed stream of JSON backupRecords, one per line, written to
+// a blob in the -backup_bucket named after the time it was taken, with a
+// random suffix so that servers backing up at the same moment don't
+// overwrite each other:
+//
+//	backups/20240102T150405.123456789Z-1a2b3c4d.jsonl.gz
+//
+// Backups hold every greeting, including pending and hidden ones, so they
+// are never kept in the -bucket_url that visitors read from. If
+// -backup_keeper is set, they are also encrypted and their keys end in
+// ".enc". Restoring a backup puts each greeting back with its original ID,
+// so restoring the same backup twice is harmless.
+//
+// Only greetings are backed up. Banners and attachments are already kept in
+// the bucket, and guestbook settings in -books_url.
+
+const (
+	// backupPrefix is the bucket prefix under which backups are kept.
+	backupPrefix = "backups/"
+	// backupTimeFormat formats the time in a backup's key, so that keys sort
+	// in chronological order.
+	backupTimeFormat = "20060102T150405.000000000Z"
+	// maxWrappedKeySize is the largest encrypted data key accepted in an
+	// encrypted backup.
+	maxWrappedKeySize = 64 << 10
+)
+
+var errNoBackupBucket = errors.New("set -backup_bucket to take or restore backups")
+
+// A backupRecord is the backup of a single greeting.
+type backupRecord struct {
+	ID         string    `json:"id"`
+	Book       string    `json:"book,omitempty"`
+	Content    string    `json:"content"`
+	PostDate   time.Time `json:"post_date"`
+	Attachment string    `json:"attachment,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Likes      int64     `json:"likes,omitempty"`
+}
+
+// backups takes and restores backups of the greetings in store.
+type backups struct {
+	store  greetingStore
+	bucket *blob.Bucket // nil without -backup_bucket
+	// keeper encrypts new backups and decrypts encrypted ones. It is nil if
+	// backups are not encrypted.
+	keeper *secrets.Keeper
+}
+
+// openBackups is a Wire provider function that returns the backups of the
+// greetings in store, kept in the bucket named by -backup_bucket.
+func openBackups(ctx context.Context, flags *cliFlags, store greetingStore) (*backups, func(), error) {
+	b := &backups{store: store}
+	if flags.backupBucketURL == "" {
+		return b, func() {}, nil
+	}
+	if flags.backupBucketURL == flags.bucketURL {
+		return nil, nil, errors.New("-backup_bucket must not be -bucket_url, which visitors can read from")
+	}
+	bb, err := blob.OpenBucket(ctx, flags.backupBucketURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening -backup_bucket: %v", err)
+	}
+	b.bucket = bb
+	if flags.backupKeeperURL != "" {
+		keeper, err := secrets.OpenKeeper(ctx, flags.backupKeeperURL)
+		if err != nil {
+			bb.Close()
+			return nil, nil, fmt.Errorf("opening -backup_keeper: %v", err)
+		}
+		b.keeper = keeper
+	}
+	return b, func() {
+		bb.Close()
+		if b.keeper != nil {
+			b.keeper.Close()
+		}
+	}, nil
+}
+
+// backupKey returns the key of an unencrypted backup taken at t.
+func backupKey(t time.Time) (string, error) {
+	var suffix [4]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s-%s.jsonl.gz", backupPrefix, t.UTC().Format(backupTimeFormat), hex.EncodeToString(suffix[:])), nil
+}
+
+// backup writes a backup of all greetings and returns its key and the number
+// of greetings in it.
+func (b *backups) backup(ctx context.Context) (key string, n int, err error) {
+	if b.bucket == nil {
+		return "", 0, errNoBackupBucket
+	}
+	key, err = backupKey(time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	err = b.store.each(ctx, func(g *greeting) error {
+		n++
+		return enc.Encode(&backupRecord{
+			ID:         g.ID,
+			Book:       g.Book,
+			Content:    g.Content,
+			PostDate:   g.PostDate,
+			Attachment: g.Attachment,
+			Status:     g.Status,
+			Likes:      g.Likes,
+		})
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	data := buf.Bytes()
+	contentType := "application/gzip"
+	if b.keeper != nil {
+		if data, err = sealBackup(ctx, b.keeper, data); err != nil {
+			return "", 0, err
+		}
+		key += ".enc"
+		contentType = "application/octet-stream"
+	}
+	if err := b.bucket.WriteAll(ctx, key, data, &blob.WriterOptions{ContentType: contentType}); err != nil {
+		return "", 0, err
+	}
+	return key, n, nil
+}
+
+// latest returns the key of the most recent backup.
+func (b *backups) latest(ctx context.Context) (string, error) {
+	if b.bucket == nil {
+		return "", errNoBackupBucket
+	}
+	var key string
+	iter := b.bucket.List(&blob.ListOptions{Prefix: backupPrefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if !obj.IsDir && obj.Key > key {
+			key = obj.Key
+		}
+	}
+	if key == "" {
+		return "", errors.New("no backups found")
+	}
+	return key, nil
+}
+
+// restore puts back the greetings in the backup with the given key, and
+// returns how many there were. Greetings with the same IDs are replaced.
+func (b *backups) restore(ctx context.Context, key string) (n int, err error) {
+	if b.bucket == nil {
+		return 0, errNoBackupBucket
+	}
+	encrypted := strings.HasSuffix(key, ".enc")
+	if encrypted && b.keeper == nil {
+		return 0, fmt.Errorf("backup %s is encrypted; set -backup_keeper to restore it", key)
+	}
+	data, err := b.bucket.ReadAll(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if encrypted {
+		if data, err = unsealBackup(ctx, b.keeper, data); err != nil {
+			return 0, fmt.Errorf("decrypting backup %s: %v", key, err)
+		}
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("reading backup %s: %v", key, err)
+	}
+	dec := json.NewDecoder(zr)
+	for {
+		var rec backupRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("reading backup %s: %v", key, err)
+		}
+		g := &greeting{
+			ID:         rec.ID,
+			Content:    rec.Content,
+			PostDate:   rec.PostDate,
+			Attachment: rec.Attachment,
+			Status:     rec.Status,
+			Likes:      rec.Likes,
+		}
+		if err := b.store.forBook(rec.Book).put(ctx, g); err != nil {
+			return n, fmt.Errorf("restoring greeting %s: %v", rec.ID, err)
+		}
+		n++
+	}
+}
+
+// schedule takes a backup every interval until the returned function is
+// called. It does nothing if interval is not positive.
+func (b *backups) schedule(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			key, n, err := b.backup(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("backup error:", err)
+				}
+				continue
+			}
+			log.Printf("Backed up %d greetings to %s", n, key)
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// Encrypted backups use envelope encryption, because keepers backed by a KMS
+// only encrypt a few kilobytes at a time: each backup is encrypted by a
+// localsecrets keeper with a new random key, and only that key is encrypted
+// by -backup_keeper. An encrypted backup is the length of the encrypted key
+// as a 4-byte big-endian integer, the encrypted key, and the encrypted
+// backup.
+
+// sealBackup encrypts the backup data with keeper.
+func sealBackup(ctx context.Context, keeper *secrets.Keeper, data []byte) ([]byte, error) {
+	key, err := localsecrets.NewRandomKey()
+	if err != nil {
+		return nil, err
+	}
+	dataKeeper := localsecrets.NewKeeper(key)
+	defer dataKeeper.Close()
+	sealed, err := dataKeeper.Encrypt(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := keeper.Encrypt(ctx, key[:])
+	if err != nil {
+		return nil, fmt.Errorf("encrypting backup key: %v", err)
+	}
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(wrapped)))
+	out = append(out, wrapped...)
+	return append(out, sealed...), nil
+}
+
+// unsealBackup decrypts backup data encrypted by sealBackup with keeper.
+func unsealBackup(ctx context.Context, keeper *secrets.Keeper, data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("encrypted backup is truncated")
+	}
+	size := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if size > maxWrappedKeySize || int(size) > len(data) {
+		return nil, errors.New("encrypted backup has an invalid key")
+	}
+	key, err := keeper.Decrypt(ctx, data[:size])
+	if err != nil {
+		return nil, fmt.Errorf("decrypting backup key: %v", err)
+	}
+	var sk [32]byte
+	if len(key) != len(sk) {
+		return nil, errors.New("encrypted backup has an invalid key")
+	}
+	copy(sk[:], key)
+	dataKeeper := localsecrets.NewKeeper(sk)
+	defer dataKeeper.Close()
+	return dataKeeper.Decrypt(ctx, data[size:])
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/secrets"
+	_ "gocloud.dev/secrets/localsecrets"
+)
+
+func TestBackupRestore(t *testing.T) {
+	for _, keeperURL := range []string{"", "base64key://"} {
+		name := "plain"
+		if keeperURL != "" {
+			name = "encrypted"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			flags := &cliFlags{greetingsURL: "mem://greetings-Backup-" + name + "/ID", backupBucketURL: "mem://", backupKeeperURL: keeperURL}
+			store, cleanup, err := openGreetingStore(ctx, nil, flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			start := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+			want := []greeting{
+				{ID: "g0", Content: "Hello!", PostDate: start, Status: statusApproved},
+				{ID: "g1", Book: "other", Content: "Hi there", PostDate: start.Add(time.Minute), Attachment: "attachments/g1", Status: statusApproved},
+				{ID: "g2", Content: "Wait for it", PostDate: start.Add(2 * time.Minute), Status: statusPending},
+			}
+			for _, g := range want {
+				g := g
+				if err := store.forBook(g.Book).add(ctx, &g); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, cleanupBackups, err := openBackups(ctx, flags, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupBackups()
+			key, n, err := b.backup(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(want) {
+				t.Errorf("backed up %d greetings, want %d", n, len(want))
+			}
+			if !strings.HasPrefix(key, backupPrefix) || strings.HasSuffix(key, ".enc") != (keeperURL != "") {
+				t.Errorf("backup key %q has the wrong form", key)
+			}
+			if got, err := b.latest(ctx); err != nil || got != key {
+				t.Errorf("latest: got %q, %v; want %q", got, err, key)
+			}
+			if keeperURL != "" {
+				data, err := b.bucket.ReadAll(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(data, []byte("Hello!")) {
+					t.Error("encrypted backup contains a greeting in plaintext")
+				}
+			}
+
+			// Restore into an empty store, twice: restoring is idempotent.
+			restored, cleanup, err := openGreetingStore(ctx, nil, &cliFlags{greetingsURL: "mem://greetings-Restore-" + name + "/ID"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			b.store = restored
+			for i := 0; i < 2; i++ {
+				n, err := b.restore(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(want) {
+					t.Errorf("restored %d greetings, want %d", n, len(want))
+				}
+			}
+			var got []greeting
+			err = restored.each(ctx, func(g *greeting) error {
+				got = append(got, *g)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+			if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(greeting{}, "DocstoreRevision")); diff != "" {
+				t.Errorf("restored greetings (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBackupKey(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	var keys [3]string
+	for i, at := range []time.Time{now, now, now.Add(time.Millisecond)} {
+		key, err := backupKey(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	// Servers backing up at the same time don't overwrite each other's
+	// backups, and later backups sort after earlier ones.
+	if keys[0] == keys[1] {
+		t.Errorf("two backups at %v both have key %q", now, keys[0])
+	}
+	if keys[2] <= keys[0] || keys[2] <= keys[1] {
+		t.Errorf("backup key %q sorts before earlier keys %q", keys[2], keys[:2])
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	ctx := context.Background()
+	// Backups need a bucket of their own.
+	if _, _, err := openBackups(ctx, &cliFlags{bucketURL: "mem://", backupBucketURL: "mem://"}, nil); err == nil {
+		t.Error("opened backups in the guestbook's bucket")
+	}
+	none := &backups{}
+	if _, _, err := none.backup(ctx); err != errNoBackupBucket {
+		t.Errorf("backup without -backup_bucket: got %v, want %v", err, errNoBackupBucket)
+	}
+	if _, err := none.latest(ctx); err != errNoBackupBucket {
+		t.Errorf("latest without -backup_bucket: got %v, want %v", err, errNoBackupBucket)
+	}
+
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	b := &backups{bucket: bucket}
+	if _, err := b.latest(ctx); err == nil {
+		t.Error("latest succeeded without backups")
+	}
+	if err := bucket.WriteAll(ctx, backupPrefix+"20190701T000000Z.jsonl.gz.enc", []byte("secret"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.restore(ctx, backupPrefix+"20190701T000000Z.jsonl.gz.enc"); err == nil {
+		t.Error("restored an encrypted backup without a keeper")
+	}
+	if _, err := b.restore(ctx, backupPrefix+"missing.jsonl.gz"); err == nil {
+		t.Error("restored a missing backup")
+	}
+}
+
+func TestSealedBackup(t *testing.T) {
+	ctx := context.Background()
+	keeper, err := secrets.OpenKeeper(ctx, "base64key://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keeper.Close()
+
+	plain := make([]byte, 100<<10)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealBackup(ctx, keeper, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := unsealBackup(ctx, keeper, sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("unsealBackup: got %d bytes, %v; want the original %d bytes", len(got), err, len(plain))
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", sealed[:len(sealed)-10]},
+		{"key only", sealed[:4+binary.BigEndian.Uint32(sealed)]},
+		{"tampered", tampered},
+		{"empty", nil},
+	} {
+		if _, err := unsealBackup(ctx, keeper, test.data); err == nil {
+			t.Errorf("unsealed a %s backup", test.name)
+		}
+	}
+
+	other, err := secrets.OpenKeeper(ctx, "base64key://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := unsealBackup(ctx, other, sealed); err == nil {
+		t.Error("unsealed a backup with the wrong keeper")
+	}
+}
@@ -0,0 +1,562 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gocloud.dev/blob"
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/blobvar"
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+// Besides the main guestbook, the server hosts any number of other guestbooks
+// ("books"), for example one per event. Each book is served under /g/{book}/
+// with the same pages and API as the main guestbook, and has its own
+// greetings, its own part of the bucket for its banner and attachments, and
+// optionally its own message of the day.
+//
+// Books' configurations are kept in the docstore collection at -books_url,
+// keyed by Name, and are created with the admin endpoint POST /admin/books.
+// Without -books_url, only the main guestbook is served.
+
+// bookConfigTTL is how long a server uses a book's configuration before
+// reading it again, to pick up changes made through other servers.
+const bookConfigTTL = time.Minute
+
+// bookNameRE matches valid book names, which are used in URL paths and
+// bucket keys.
+var bookNameRE = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{0,62}[a-z0-9])?$`)
+
+// reservedBookNames can't be used as book names, because the main guestbook
+// uses the corresponding bucket prefixes.
+var reservedBookNames = map[string]bool{
+	"attachments": true,
+	"audit":       true,
+	"backups":     true,
+}
+
+var (
+	errBookNotFound = errors.New("no such guestbook")
+	errBookExists   = errors.New("guestbook already exists")
+	errNoBooks      = errors.New("set -books_url to host other guestbooks")
+)
+
+// A book is the configuration of a guestbook other than the main one.
+type book struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	// MOTDVar is the gocloud.dev/runtimevar URL of the book's message of the
+	// day: either a constant:// URL, or a blob:// URL of a key in the book's
+	// part of the bucket. Variables from anywhere else aren't allowed, since
+	// whatever they hold is shown to visitors. If empty, the main guestbook's
+	// message of the day is shown.
+	MOTDVar string `json:"motd_var,omitempty"`
+	// Banner is the key of the book's banner image in its bucket; empty if
+	// the book has no banner of its own.
+	Banner string `json:"banner,omitempty"`
+}
+
+// validate reports whether b is a valid configuration for a new book.
+func (b *book) validate() error {
+	if !bookNameRE.MatchString(b.Name) || reservedBookNames[b.Name] {
+		return errors.New("name must be 1 to 64 lowercase letters, digits and dashes, not starting or ending with a dash")
+	}
+	if b.Title == "" {
+		return errors.New("title must not be empty")
+	}
+	if b.MOTDVar != "" {
+		if _, err := parseBookMOTDVar(b.MOTDVar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBookMOTDVar parses the URL of a book's message of the day variable,
+// and checks that it is one of the kinds allowed for books.
+func parseBookMOTDVar(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("motd_var: %v", err)
+	}
+	switch u.Scheme {
+	case constantvar.Scheme:
+		return u, nil
+	case blobvar.Scheme:
+		if u.Host == "" {
+			return nil, errors.New("motd_var: blob:// URL has no key")
+		}
+		return u, nil
+	}
+	return nil, errors.New("motd_var must be a constant:// URL or a blob:// URL of a key in the guestbook's part of the bucket")
+}
+
+// bookPath returns the URL path prefix of the named book: "/g/{book}", or ""
+// for the main guestbook.
+func bookPath(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "/g/" + name
+}
+
+// A bookBucketOpener opens the bucket that holds the named book's files,
+// usually the part of the main bucket under "{book}/". blob.PrefixedBucket
+// takes ownership of the bucket it wraps, so each book needs a bucket of its
+// own rather than one shared with the main guestbook.
+type bookBucketOpener func(ctx context.Context, book string) (*blob.Bucket, error)
+
+// A bookRegistry loads and caches the configuration and resources of books.
+// Resources are opened without holding mu, so that a slow open holds up only
+// the requests for that book; if two requests open the same resource at
+// once, the second one closes its copy.
+type bookRegistry struct {
+	coll       *docstore.Collection // the configurations; nil if there are no books
+	openBucket bookBucketOpener
+
+	mu       sync.Mutex
+	books    map[string]*loadedBook
+	buckets  map[string]*blob.Bucket // by book name
+	motdVars map[string]*bookMOTDVar // by book name
+}
+
+// A bookMOTDVar is the message of the day variable opened for a book.
+type bookMOTDVar struct {
+	url string
+	v   *runtimevar.Variable
+}
+
+// A loadedBook is a book's configuration as read at a given time.
+type loadedBook struct {
+	book
+	loaded time.Time
+}
+
+// openBookRegistry is a Wire provider function that opens the collection of
+// books' configurations at -books_url. If the flag is empty, the registry has
+// no books.
+func openBookRegistry(ctx context.Context, flags *cliFlags, openBucket bookBucketOpener) (*bookRegistry, func(), error) {
+	if flags.booksURL == "" {
+		r, cleanup := newBookRegistry(nil, openBucket)
+		return r, cleanup, nil
+	}
+	coll, err := docstore.OpenCollection(ctx, flags.booksURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening -books_url: %v", err)
+	}
+	r, cleanup := newBookRegistry(coll, openBucket)
+	return r, func() {
+		cleanup()
+		coll.Close()
+	}, nil
+}
+
+// newBookRegistry returns a registry of the books configured in coll.
+func newBookRegistry(coll *docstore.Collection, openBucket bookBucketOpener) (*bookRegistry, func()) {
+	r := &bookRegistry{
+		coll:       coll,
+		openBucket: openBucket,
+		books:      make(map[string]*loadedBook),
+		buckets:    make(map[string]*blob.Bucket),
+		motdVars:   make(map[string]*bookMOTDVar),
+	}
+	return r, r.close
+}
+
+// close releases the books' buckets and variables.
+func (r *bookRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, b := range r.buckets {
+		b.Close()
+	}
+	for _, mv := range r.motdVars {
+		mv.v.Close()
+	}
+}
+
+// get returns the configuration of the named book, or errBookNotFound.
+func (r *bookRegistry) get(ctx context.Context, name string) (*book, error) {
+	r.mu.Lock()
+	lb := r.books[name]
+	r.mu.Unlock()
+	if lb != nil && time.Since(lb.loaded) < bookConfigTTL {
+		return &lb.book, nil
+	}
+	if r.coll == nil || !bookNameRE.MatchString(name) {
+		return nil, errBookNotFound
+	}
+	b := &book{Name: name}
+	err := r.coll.Get(ctx, b)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, errBookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading configuration of guestbook %q: %v", name, err)
+	}
+	r.mu.Lock()
+	r.books[name] = &loadedBook{book: *b, loaded: time.Now()}
+	r.mu.Unlock()
+	return b, nil
+}
+
+// cache records b as the current configuration of its book.
+func (r *bookRegistry) cache(b *book) {
+	r.mu.Lock()
+	r.books[b.Name] = &loadedBook{book: *b, loaded: time.Now()}
+	r.mu.Unlock()
+}
+
+// setBanner sets the banner of the named book to the given key, and returns
+// the book's updated configuration.
+func (r *bookRegistry) setBanner(ctx context.Context, name, key string) (*book, error) {
+	if r.coll == nil {
+		return nil, errBookNotFound
+	}
+	b := &book{Name: name}
+	if err := r.coll.Update(ctx, b, docstore.Mods{"Banner": key}); err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, errBookNotFound
+		}
+		return nil, err
+	}
+	if err := r.coll.Get(ctx, b); err != nil {
+		return nil, err
+	}
+	r.cache(b)
+	return b, nil
+}
+
+// create stores the configuration of a new book. It returns errBookExists if
+// there already is a book with the same name, even if it is being created by
+// another server at the same time.
+func (r *bookRegistry) create(ctx context.Context, b *book) error {
+	if r.coll == nil {
+		return errNoBooks
+	}
+	if err := r.coll.Create(ctx, b); err != nil {
+		if gcerrors.Code(err) == gcerrors.AlreadyExists {
+			return errBookExists
+		}
+		return err
+	}
+	r.cache(b)
+	return nil
+}
+
+// remove deletes the configuration of the named book.
+func (r *bookRegistry) remove(ctx context.Context, name string) error {
+	if err := r.coll.Delete(ctx, &book{Name: name}); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	delete(r.books, name)
+	r.mu.Unlock()
+	return nil
+}
+
+// bookBucket returns the bucket of the named book.
+func (r *bookRegistry) bookBucket(ctx context.Context, name string) (*blob.Bucket, error) {
+	r.mu.Lock()
+	b := r.buckets[name]
+	r.mu.Unlock()
+	if b != nil {
+		return b, nil
+	}
+	b, err := r.openBucket(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if other := r.buckets[name]; other != nil {
+		b.Close()
+		return other, nil
+	}
+	r.buckets[name] = b
+	return b, nil
+}
+
+// motdVar returns the message of the day variable of the named book, with
+// the given URL. blob:// URLs name keys in the book's bucket. When the book's
+// URL changes, the variable opened for the old one is closed.
+func (r *bookRegistry) motdVar(ctx context.Context, name, motdURL string) (*runtimevar.Variable, error) {
+	r.mu.Lock()
+	mv := r.motdVars[name]
+	r.mu.Unlock()
+	if mv != nil && mv.url == motdURL {
+		return mv.v, nil
+	}
+	// Configurations stored before URLs were checked may have others.
+	u, err := parseBookMOTDVar(motdURL)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := r.bookBucket(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var v *runtimevar.Variable
+	if u.Scheme == blobvar.Scheme {
+		opener := &blobvar.URLOpener{Bucket: bucket, Decoder: runtimevar.StringDecoder}
+		v, err = opener.OpenVariableURL(ctx, u)
+	} else {
+		v, err = runtimevar.OpenVariable(ctx, motdURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	mv = r.motdVars[name]
+	if mv != nil && mv.url == motdURL {
+		r.mu.Unlock()
+		v.Close()
+		return mv.v, nil
+	}
+	r.motdVars[name] = &bookMOTDVar{url: motdURL, v: v}
+	r.mu.Unlock()
+	if mv != nil {
+		mv.v.Close()
+	}
+	return v, nil
+}
+
+// forBook returns an application that serves the named book, or
+// errBookNotFound.
+func (app *application) forBook(ctx context.Context, name string) (*application, error) {
+	b, err := app.books.get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := app.books.bookBucket(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	motdVar := app.motdVar
+	if b.MOTDVar != "" {
+		if motdVar, err = app.books.motdVar(ctx, name, b.MOTDVar); err != nil {
+			return nil, err
+		}
+	}
+	bookApp := *app
+	bookApp.store = app.store.forBook(name)
+	bookApp.bucket = bucket
+	bookApp.motdVar = motdVar
+	bookApp.book = b
+	return &bookApp, nil
+}
+
+// bookName returns the name of the book that app serves; "" for the main
+// guestbook.
+func (app *application) bookName() string {
+	if app.book == nil {
+		return ""
+	}
+	return app.book.Name
+}
+
+// title returns the title of the guestbook that app serves.
+func (app *application) title() string {
+	if app.book == nil {
+		return "Guestbook"
+	}
+	return app.book.Title
+}
+
+// A bookHandler handles a request for a page of a guestbook.
+type bookHandler func(app *application, w http.ResponseWriter, r *http.Request)
+
+// inBook returns a handler that calls h with an application serving the book
+// named in the request path.
+func (app *application) inBook(h bookHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bookApp, err := app.forBook(r.Context(), mux.Vars(r)["book"])
+		if err == errBookNotFound {
+			http.Error(w, "no such guestbook", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("loading guestbook:", err)
+			http.Error(w, "could not load guestbook", http.StatusInternalServerError)
+			return
+		}
+		h(bookApp, w, r)
+	}
+}
+
+// adminBooks handles POST /admin/books, which creates a book from a JSON
+// request body such as
+//
+//	{"name": "gophercon", "title": "GopherCon", "motd_var": "constant://?val=Welcome!&decoder=string"}
+//
+// and returns the book's configuration.
+func (app *application) adminBooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeAPIJSON(w, http.StatusMethodNotAllowed, &apiError{Error: apiErrorDetail{
+			Code:    gcerrors.Unimplemented.String(),
+			Message: "only POST allowed",
+		}})
+		return
+	}
+	var b book
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&b); err != nil {
+		writeAPIError(w, gcerrors.InvalidArgument, "malformed JSON request: "+err.Error())
+		return
+	}
+	if b.Banner != "" {
+		writeAPIError(w, gcerrors.InvalidArgument, "upload the banner with PUT /admin/books/{book}/banner")
+		return
+	}
+	if err := b.validate(); err != nil {
+		writeAPIError(w, gcerrors.InvalidArgument, err.Error())
+		return
+	}
+	err := app.books.create(r.Context(), &b)
+	switch err {
+	case nil:
+	case errBookExists:
+		writeAPIError(w, gcerrors.AlreadyExists, err.Error())
+		return
+	case errNoBooks:
+		writeAPIError(w, gcerrors.FailedPrecondition, err.Error())
+		return
+	default:
+		log.Println("creating guestbook:", err)
+		writeAPIError(w, gcerrors.Code(err), "could not create guestbook")
+		return
+	}
+	if b.MOTDVar != "" {
+		// Check that the variable can be opened, now that the book is ours.
+		if _, err := app.books.motdVar(r.Context(), b.Name, b.MOTDVar); err != nil {
+			if rerr := app.books.remove(r.Context(), b.Name); rerr != nil {
+				log.Println("removing guestbook:", rerr)
+			}
+			writeAPIError(w, gcerrors.InvalidArgument, "motd_var: "+err.Error())
+			return
+		}
+	}
+	app.audit.record(r.Context(), &auditEntry{User: adminUser(r), Action: "create guestbook", Book: b.Name, Detail: b.Title})
+	w.Header().Set("Location", bookPath(b.Name)+"/")
+	writeAPIJSON(w, http.StatusCreated, &b)
+}
+
+// adminBookBanner handles PUT /admin/books/{book}/banner, which replaces the
+// book's banner with the image in the request body.
+func (app *application) adminBookBanner(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		w.Header().Set("Allow", "PUT")
+		writeAPIJSON(w, http.StatusMethodNotAllowed, &apiError{Error: apiErrorDetail{
+			Code:    gcerrors.Unimplemented.String(),
+			Message: "only PUT allowed",
+		}})
+		return
+	}
+	bookApp, err := app.forBook(r.Context(), mux.Vars(r)["book"])
+	if err == errBookNotFound {
+		writeAPIError(w, gcerrors.NotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("loading guestbook:", err)
+		writeAPIError(w, gcerrors.Code(err), "could not load guestbook")
+		return
+	}
+	b, err := bookApp.replaceBanner(r.Context(), r.Body)
+	switch err {
+	case nil:
+	case errAttachmentTooLarge:
+		writeAPIJSON(w, http.StatusRequestEntityTooLarge, &apiError{Error: apiErrorDetail{
+			Code:    gcerrors.InvalidArgument.String(),
+			Message: err.Error(),
+		}})
+		return
+	case errBannerType:
+		writeAPIJSON(w, http.StatusUnsupportedMediaType, &apiError{Error: apiErrorDetail{
+			Code:    gcerrors.InvalidArgument.String(),
+			Message: err.Error(),
+		}})
+		return
+	default:
+		log.Println("replacing guestbook banner:", err)
+		writeAPIError(w, gcerrors.Code(err), "could not save banner")
+		return
+	}
+	app.audit.record(r.Context(), &auditEntry{User: adminUser(r), Action: "replace banner", Book: b.Name})
+	writeAPIJSON(w, http.StatusOK, b)
+}
+
+// errBannerType is returned by replaceBanner for files that aren't images.
+var errBannerType = errors.New("banner must be a GIF, JPEG, PNG or WebP image")
+
+// replaceBanner replaces the banner of the guestbook that app serves with the
+// image read from r, and returns the guestbook's updated configuration. The
+// main guestbook's banner is the environment's banner, which has no
+// configuration, so replaceBanner returns nil for it.
+func (app *application) replaceBanner(ctx context.Context, r io.Reader) (*book, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxAttachmentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAttachmentSize {
+		return nil, errAttachmentTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	if _, ok := attachmentTypes[contentType]; !ok {
+		return nil, errBannerType
+	}
+	key := "banner"
+	if app.book == nil {
+		if _, key = envBanner(); key == "" {
+			return nil, errors.New("this environment has no banner")
+		}
+	}
+	if err := app.bucket.WriteAll(ctx, key, data, &blob.WriterOptions{ContentType: contentType}); err != nil {
+		return nil, err
+	}
+	if app.book == nil {
+		return nil, nil
+	}
+	return app.books.setBanner(ctx, app.book.Name, key)
+}
+
+// motdText returns the message of the day held in a variable's value, which
+// is a string or, for variables opened by URL without a decoder, bytes.
+func motdText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/docstore/memdocstore"
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+func TestBooks(t *testing.T) {
+	ctx := context.Background()
+	store, storeCleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storeCleanup()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	openBook, err := openBookBuckets(&cliFlags{bucketURL: "mem://"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll, err := memdocstore.OpenCollection("Name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	books, booksCleanup := newBookRegistry(coll, openBook)
+	defer booksCleanup()
+	motd := constantvar.New("Main message")
+	defer motd.Close()
+	hub, hubCleanup, err := openEventHub(ctx, &cliFlags{}, newDrainCheck())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hubCleanup()
+	router := newRouter(newApplication(store, bucket, motd, nil, nil, hub, books, &adminAuth{}, nil, nil, nil, nil, ""))
+
+	do := func(method, target, contentType string, body io.Reader) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, body)
+		r.RemoteAddr = "127.0.0.1:1234" // admin pages are open to local clients with -insecure_local_admin
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	createBook := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		return do("POST", "/admin/books", "application/json", strings.NewReader(body))
+	}
+	sign := func(prefix, content string) {
+		t.Helper()
+		w := do("POST", prefix+"/sign", "application/x-www-form-urlencoded", strings.NewReader(url.Values{"content": {content}}.Encode()))
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != prefix+"/" {
+			t.Fatalf("POST %s/sign: got %d to %q, want %d to %s/", prefix, w.Code, w.Header().Get("Location"), http.StatusSeeOther, prefix)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"name": "Bad Name", "title": "Bad"}`,
+		`{"name": "-dash", "title": "Bad"}`,
+		`{"name": "attachments", "title": "Reserved"}`,
+		`{"name": "untitled"}`,
+		`{"name": "badvar", "title": "Bad", "motd_var": "nosuchscheme://x"}`,
+		`{"name": "filevar", "title": "Bad", "motd_var": "file:///etc/passwd?decoder=string"}`,
+		`{"name": "httpvar", "title": "Bad", "motd_var": "http://169.254.169.254/latest/meta-data/?decoder=string"}`,
+		`{"name": "nokey", "title": "Bad", "motd_var": "blob://"}`,
+		`{"name": "typo", "titel": "Bad"}`,
+	} {
+		if w := createBook(bad); w.Code != http.StatusBadRequest {
+			t.Errorf("POST /admin/books %s: got status %d, want %d", bad, w.Code, http.StatusBadRequest)
+		}
+	}
+	const gophercon = `{"name": "gophercon", "title": "GopherCon", "motd_var": "constant://?val=Welcome+gophers&decoder=string"}`
+	if w := createBook(gophercon); w.Code != http.StatusCreated {
+		t.Fatalf("POST /admin/books: got status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if w := createBook(gophercon); w.Code != http.StatusConflict {
+		t.Errorf("creating book again: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := createBook(`{"name": "meetup", "title": "Meetup"}`); w.Code != http.StatusCreated {
+		t.Fatalf("POST /admin/books: got status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	// A blob:// message of the day is read from the book's own bucket.
+	rallyBucket, err := books.bookBucket(ctx, "rally")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rallyBucket.WriteAll(ctx, "motd.txt", []byte("Welcome to the rally"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if w := createBook(`{"name": "rally", "title": "Rally", "motd_var": "blob://motd.txt"}`); w.Code != http.StatusCreated {
+		t.Fatalf("POST /admin/books: got status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	// Configurations stored before URLs were checked aren't trusted either.
+	if err := coll.Put(ctx, &book{Name: "legacy", Title: "Legacy", MOTDVar: "file:///etc/passwd?decoder=string"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := do("GET", "/g/legacy/", "", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("GET book with a file:// message of the day: got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	// Changing a book's message of the day closes the variable of the old one.
+	oldVar, err := books.motdVar(ctx, "meetup", "constant://?val=Old&decoder=string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newVar, err := books.motdVar(ctx, "meetup", "constant://?val=New&decoder=string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oldVar.Latest(ctx); err == nil {
+		t.Error("old message of the day variable is still open")
+	}
+	if snap, err := newVar.Latest(ctx); err != nil || snap.Value != "New" {
+		t.Errorf("new message of the day: got %v, %v, want New", snap.Value, err)
+	}
+
+	if w := do("GET", "/g/nosuchbook/", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET unknown book: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do("GET", "/g/gophercon", "", nil); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/g/gophercon/" {
+		t.Errorf("GET /g/gophercon: got %d to %q, want redirect to /g/gophercon/", w.Code, w.Header().Get("Location"))
+	}
+
+	// Each book has its own greetings and message of the day; books without a
+	// message of the day show the main one.
+	sign("", "Hello from the main guestbook")
+	sign("/g/gophercon", "Hello from GopherCon")
+	for _, test := range []struct {
+		prefix  string
+		want    []string
+		notWant string
+	}{
+		{"", []string{"<h1>Guestbook</h1>", "Main message", "Hello from the main guestbook"}, "Hello from GopherCon"},
+		{"/g/gophercon", []string{"<h1>GopherCon</h1>", "Welcome gophers", "Hello from GopherCon", `action="/g/gophercon/sign"`}, "Hello from the main guestbook"},
+		{"/g/meetup", []string{"<h1>Meetup</h1>", "Main message"}, "Hello from"},
+		{"/g/rally", []string{"<h1>Rally</h1>", "Welcome to the rally"}, "Main message"},
+	} {
+		w := do("GET", test.prefix+"/", "", nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s/: got status %d, want %d", test.prefix, w.Code, http.StatusOK)
+			continue
+		}
+		body := w.Body.String()
+		for _, want := range test.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("GET %s/: page does not contain %q:\n%s", test.prefix, want, body)
+			}
+		}
+		if strings.Contains(body, test.notWant) {
+			t.Errorf("GET %s/: page contains %q", test.prefix, test.notWant)
+		}
+	}
+
+	w := do("GET", "/g/gophercon/api/v1/greetings", "", nil)
+	var list apiGreetingPage
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Greetings) != 1 || list.Greetings[0].Book != "gophercon" || list.Greetings[0].Content != "Hello from GopherCon" {
+		t.Errorf("GET /g/gophercon/api/v1/greetings: got %+v, want the GopherCon greeting", list.Greetings)
+	}
+
+	// A book can have its own banner.
+	banner, err := os.ReadFile("blobs/gophers.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := do("PUT", "/admin/books/gophercon/banner", "image/jpeg", strings.NewReader("not an image")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT text banner: got status %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+	if w := do("PUT", "/admin/books/nosuchbook/banner", "image/jpeg", bytes.NewReader(banner)); w.Code != http.StatusNotFound {
+		t.Errorf("PUT banner of unknown book: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do("PUT", "/admin/books/gophercon/banner", "image/jpeg", bytes.NewReader(banner)); w.Code != http.StatusOK {
+		t.Fatalf("PUT banner: got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if body := do("GET", "/g/gophercon/", "", nil).Body.String(); !strings.Contains(body, `src="/g/gophercon/blob/banner"`) {
+		t.Errorf("book page does not show its banner:\n%s", body)
+	}
+	w = do("GET", "/g/gophercon/blob/banner", "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" || !bytes.Equal(w.Body.Bytes(), banner) {
+		t.Errorf("GET banner: got status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if body := do("GET", "/g/meetup/", "", nil).Body.String(); strings.Contains(body, "/g/meetup/blob/banner") {
+		t.Error("book without a banner shows one")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gocloud.dev/mysql"
+	_ "gocloud.dev/mysql/awsmysql"
+	_ "gocloud.dev/mysql/azuremysql"
+	_ "gocloud.dev/mysql/gcpmysql"
+	"gocloud.dev/postgres"
+	_ "gocloud.dev/postgres/awspostgres"
+	_ "gocloud.dev/postgres/gcppostgres"
+)
+
+// A sqlDialect is a flavor of SQL.
+type sqlDialect string
+
+const (
+	dialectMySQL    sqlDialect = "mysql"
+	dialectPostgres sqlDialect = "postgres"
+)
+
+// sqlDialects maps the schemes of database URLs to the dialects of the
+// databases they name.
+var sqlDialects = map[string]sqlDialect{
+	"mysql":       dialectMySQL,
+	"awsmysql":    dialectMySQL,
+	"azuremysql":  dialectMySQL,
+	"gcpmysql":    dialectMySQL,
+	"postgres":    dialectPostgres,
+	"awspostgres": dialectPostgres,
+	"gcppostgres": dialectPostgres,
+}
+
+// dialectForURL returns the dialect of the database at urlstr.
+func dialectForURL(urlstr string) (sqlDialect, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", fmt.Errorf("-db_url: %v", err)
+	}
+	d, ok := sqlDialects[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("-db_url: unknown scheme %q; want one of mysql, awsmysql, azuremysql, gcpmysql, postgres, awspostgres or gcppostgres", u.Scheme)
+	}
+	return d, nil
+}
+
+// flagsDialect returns the dialect of the database named by the
+// command-line flags. Without -db_url, the database is MySQL.
+func flagsDialect(flags *cliFlags) (sqlDialect, error) {
+	if flags.dbURL == "" {
+		return dialectMySQL, nil
+	}
+	return dialectForURL(flags.dbURL)
+}
+
+// openDatabaseURL opens the database at urlstr with gocloud.dev/mysql or
+// gocloud.dev/postgres, depending on its scheme. MySQL URLs are opened with
+// parseTime=true, which the greeting store needs.
+func openDatabaseURL(ctx context.Context, urlstr string) (*sql.DB, func(), error) {
+	d, err := dialectForURL(urlstr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var db *sql.DB
+	if d == dialectPostgres {
+		db, err = postgres.Open(ctx, urlstr)
+	} else {
+		db, err = mysql.Open(ctx, withParseTime(urlstr))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, func() { db.Close() }, nil
+}
+
+// withParseTime returns the MySQL URL urlstr with parseTime=true, without
+// which the driver returns DATETIME columns, such as post_date, as bytes that
+// can't be scanned into a time.Time.
+func withParseTime(urlstr string) string {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return urlstr
+	}
+	q := u.Query()
+	q.Set("parseTime", "true")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// rebind rewrites the ? placeholders in query for the dialect.
+func (d sqlDialect) rebind(query string) string {
+	if d != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestDialectForURL(t *testing.T) {
+	for _, test := range []struct {
+		url     string
+		want    sqlDialect
+		wantErr bool
+	}{
+		{"mysql://user:pw@localhost/guestbook", dialectMySQL, false},
+		{"gcpmysql://user:pw@project/region/instance/guestbook", dialectMySQL, false},
+		{"awsmysql://user:pw@host/guestbook", dialectMySQL, false},
+		{"azuremysql://user:pw@host/guestbook", dialectMySQL, false},
+		{"postgres://user:pw@localhost/guestbook?sslmode=disable", dialectPostgres, false},
+		{"gcppostgres://user:pw@project/region/instance/guestbook", dialectPostgres, false},
+		{"awspostgres://user:pw@host/guestbook", dialectPostgres, false},
+		{"sqlite:///tmp/guestbook.db", "", true},
+		{"::", "", true},
+	} {
+		got, err := dialectForURL(test.url)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("dialectForURL(%q) = %q, %v; want %q, error %t", test.url, got, err, test.want, test.wantErr)
+		}
+	}
+	if got, err := flagsDialect(&cliFlags{}); got != dialectMySQL || err != nil {
+		t.Errorf("dialect without -db_url = %q, %v; want %q", got, err, dialectMySQL)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	const query = "SELECT id FROM greetings WHERE book = ? AND (post_date < ? OR id < ?) LIMIT ?;"
+	if got := dialectMySQL.rebind(query); got != query {
+		t.Errorf("MySQL rebind changed the query to %q", got)
+	}
+	const want = "SELECT id FROM greetings WHERE book = $1 AND (post_date < $2 OR id < $3) LIMIT $4;"
+	if got := dialectPostgres.rebind(query); got != want {
+		t.Errorf("Postgres rebind = %q, want %q", got, want)
+	}
+}
+
+func TestWithParseTime(t *testing.T) {
+	for _, test := range []struct {
+		url, want string
+	}{
+		{"mysql://user:pw@localhost/guestbook", "mysql://user:pw@localhost/guestbook?parseTime=true"},
+		{"awsmysql://user:pw@host/guestbook?parseTime=false", "awsmysql://user:pw@host/guestbook?parseTime=true"},
+		{"gcpmysql://user:pw@project/region/instance/guestbook?charset=utf8mb4", "gcpmysql://user:pw@project/region/instance/guestbook?charset=utf8mb4&parseTime=true"},
+	} {
+		if got := withParseTime(test.url); got != test.want {
+			t.Errorf("withParseTime(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gocloud.dev/pubsub"
+)
+
+// eventKeepAlive is how often an idle event stream is sent a comment, so that
+// proxies do not close it.
+const eventKeepAlive = 30 * time.Second
+
+// eventBuffer is the number of events buffered for each client. Events for a
+// client that falls further behind are dropped.
+const eventBuffer = 16
+
+// An eventHub fans new greetings out to the browsers connected to /events.
+//
+// If an events topic is configured, new greetings are published to it, and
+// the hub receives them back from a subscription to it. Giving each server
+// instance its own subscription to the topic lets visitors see greetings
+// posted to any instance. Without a topic, greetings are only sent to the
+// browsers connected to the instance they were posted to.
+type eventHub struct {
+	topic *pubsub.Topic   // nil if there is no events topic
+	done  <-chan struct{} // closed when the server starts shutting down
+
+	mu      sync.Mutex
+	clients map[chan []byte]string // book of each client
+}
+
+// openEventHub is a Wire provider function that returns an event hub using
+// the events topic and subscription named by the command-line flags, if any.
+// The hub's event streams end when drain reports that the server is shutting
+// down.
+func openEventHub(ctx context.Context, flags *cliFlags, drain *drainCheck) (*eventHub, func(), error) {
+	hub := &eventHub{done: drain.done(), clients: make(map[chan []byte]string)}
+	if flags.eventsTopicURL == "" {
+		return hub, func() {}, nil
+	}
+	if flags.eventsSubscriptionURL == "" {
+		return nil, nil, errors.New("-events_topic requires -events_subscription")
+	}
+	topic, err := pubsub.OpenTopic(ctx, flags.eventsTopicURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	sub, err := pubsub.OpenSubscription(ctx, flags.eventsSubscriptionURL)
+	if err != nil {
+		topic.Shutdown(ctx)
+		return nil, nil, err
+	}
+	hub.topic = topic
+	// We create a context here because we are detaching.
+	recvCtx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		hub.receive(recvCtx, sub)
+	}()
+	return hub, func() {
+		cancel()
+		<-stopped
+		sub.Shutdown(context.Background())
+		topic.Shutdown(context.Background())
+	}, nil
+}
+
+// receive broadcasts the greetings received from sub until ctx is done.
+func (h *eventHub) receive(ctx context.Context, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("receiving greeting event:", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		// Events are best effort, so there is no point in redelivery.
+		msg.Ack()
+		h.broadcast(msg.Metadata["book"], msg.Body)
+	}
+}
+
+// publish sends g to the browsers connected to every server instance.
+func (h *eventHub) publish(ctx context.Context, g *greeting) error {
+	body, err := json.Marshal(newAPIGreeting(g))
+	if err != nil {
+		return err
+	}
+	if h.topic == nil {
+		h.broadcast(g.Book, body)
+		return nil
+	}
+	return h.topic.Send(ctx, &pubsub.Message{
+		Body:     body,
+		Metadata: map[string]string{"id": g.ID, "book": g.Book},
+	})
+}
+
+// broadcast sends an event to the browsers connected to this instance that
+// are watching the named book.
+func (h *eventHub) broadcast(book string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c, cbook := range h.clients {
+		if cbook != book {
+			continue
+		}
+		select {
+		case c <- data:
+		default:
+			// The client is not keeping up.
+		}
+	}
+}
+
+// subscribe returns a channel of events for the named book, and a function to
+// call once the events are no longer needed.
+func (h *eventHub) subscribe(book string) (<-chan []byte, func()) {
+	c := make(chan []byte, eventBuffer)
+	h.mu.Lock()
+	h.clients[c] = book
+	h.mu.Unlock()
+	return c, func() {
+		h.mu.Lock()
+		delete(h.clients, c)
+		h.mu.Unlock()
+	}
+}
+
+// events streams new greetings to the browser as Server-Sent Events. Each
+// event is named "greeting", and its data is the greeting in the JSON form
+// used by the API.
+func (app *application) events(w http.ResponseWriter, r *http.Request) {
+	if app.eventHub == nil {
+		http.Error(w, "live updates are disabled", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := app.eventHub.subscribe(app.bookName())
+	defer unsubscribe()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Tell nginx and similar proxies not to buffer the stream.
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case data := <-events:
+			// data is JSON without newlines, so it fits on one line.
+			if _, err := fmt.Fprintf(w, "event: greeting\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-app.eventHub.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads the next event from an event stream and returns its name
+// and data. Comments and fields other than event and data are skipped.
+func readEvent(r *bufio.Reader) (name, data string, err error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if name != "" || data != "" {
+				return name, data, nil
+			}
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	// Connect to the guestbook started by TestMain, which relays greetings
+	// through a mempubsub topic.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", memBase+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got Content-Type %q, want text/event-stream", ct)
+	}
+	// Wait for the stream to start, so that the greeting below is not
+	// posted before the server is listening for it.
+	stream := bufio.NewReader(resp.Body)
+	if line, err := stream.ReadString('\n'); err != nil || !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("got first line %q, %v; want retry", line, err)
+	}
+
+	const content = "Hello, live readers"
+	if resp := apiDo(t, "POST", "/api/v1/greetings", `{"content": "`+content+`"}`, new(apiGreeting)); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST greeting: got status %d", resp.StatusCode)
+	}
+	for {
+		name, data, err := readEvent(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "greeting" {
+			t.Fatalf("got event %q, want greeting", name)
+		}
+		var g apiGreeting
+		if err := json.Unmarshal([]byte(data), &g); err != nil {
+			t.Fatal(err)
+		}
+		// Skip greetings posted by other tests.
+		if g.Content == content {
+			break
+		}
+	}
+}
+
+func TestEventsEndOnShutdown(t *testing.T) {
+	drain := newDrainCheck()
+	hub, cleanup, err := openEventHub(context.Background(), &cliFlags{}, drain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	srv := httptest.NewServer(newRouter(newApplication(nil, nil, nil, nil, nil, hub, nil, nil, nil, nil, nil, nil, "")))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+	if _, err := stream.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a topic, greetings are sent to this server's clients directly.
+	// Clients only get the greetings of the guestbook they are watching.
+	if err := hub.publish(context.Background(), &greeting{ID: "1", Book: "other", Content: "Elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.publish(context.Background(), &greeting{ID: "2", Content: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := readEvent(stream); err != nil || !strings.Contains(data, `"Hi"`) {
+		t.Fatalf("got event data %q, %v", data, err)
+	}
+
+	drain.start()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, stream)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("reading stream: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream did not end when the server started shutting down")
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// This file implements Atom (RFC 4287) and RSS 2.0 feeds of the most recent
+// greetings, served at /feed.atom and /feed.rss of each guestbook.
+
+// feedTagPrefix starts the tag URIs (RFC 4151) that identify feeds and their
+// entries. Unlike links, they don't depend on the address the guestbook is
+// served from, so they stay the same if it moves.
+const feedTagPrefix = "tag:gocloud.dev,2024:samples/guestbook"
+
+// feedSize is the number of greetings in a feed.
+const feedSize = 20
+
+// feedTitleLength is the number of characters of a greeting used as the title
+// of its feed entry.
+const feedTitleLength = 60
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Links     []atomLink  `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        rssGUID `xml:"guid"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+// atomFeed serves an Atom feed of the most recent greetings.
+func (app *application) atomFeed(w http.ResponseWriter, r *http.Request) {
+	app.serveFeed(w, r, "application/atom+xml; charset=utf-8", func(base string, greetings []greeting, updated time.Time) interface{} {
+		feed := &atomFeed{
+			Title:   app.title(),
+			ID:      feedTagPrefix + bookPath(app.bookName()),
+			Updated: updated.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "self", Type: "application/atom+xml", Href: base + "/feed.atom"},
+				{Rel: "alternate", Type: "text/html", Href: base + "/"},
+			},
+			Author: atomAuthor{Name: "Guestbook visitors"},
+		}
+		for _, g := range greetings {
+			posted := g.PostDate.UTC().Format(time.RFC3339)
+			links := []atomLink{{Rel: "alternate", Type: "text/html", Href: greetingLink(base, &g)}}
+			if g.Attachment != "" {
+				links = append(links, atomLink{Rel: "enclosure", Href: base + "/blob/" + g.Attachment})
+			}
+			feed.Entries = append(feed.Entries, atomEntry{
+				ID:        feedEntryID(&g),
+				Title:     feedTitle(g.Content),
+				Updated:   posted,
+				Published: posted,
+				Links:     links,
+				Content:   atomContent{Type: "text", Body: g.Content},
+			})
+		}
+		return feed
+	})
+}
+
+// rssFeed serves an RSS 2.0 feed of the most recent greetings.
+func (app *application) rssFeed(w http.ResponseWriter, r *http.Request) {
+	app.serveFeed(w, r, "application/rss+xml; charset=utf-8", func(base string, greetings []greeting, updated time.Time) interface{} {
+		feed := &rssFeed{
+			Version: "2.0",
+			Channel: rssChannel{
+				Title:       app.title(),
+				Link:        base + "/",
+				Description: "The most recent greetings in the guestbook.",
+			},
+		}
+		if len(greetings) > 0 {
+			feed.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+		}
+		for _, g := range greetings {
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:       feedTitle(g.Content),
+				Link:        greetingLink(base, &g),
+				Description: g.Content,
+				PubDate:     g.PostDate.UTC().Format(time.RFC1123Z),
+				GUID:        rssGUID{ID: feedEntryID(&g)},
+			})
+		}
+		return feed
+	})
+}
+
+// serveFeed serves a feed of the most recent greetings, newest first. build
+// returns the XML document for the feed, given the base URL of the
+// guestbook (such as "https://example.com/g/gophercon"), the greetings, and
+// the time of the newest greeting.
+//
+// The base URL comes from -site_url. If that is not set, it is the address
+// the request was sent to, which the client controls, so the feed is then
+// only cached by the client.
+//
+// The feed's ETag is a hash of its content, so that a greeting approved by a
+// moderator after newer greetings were posted still changes the ETag.
+func (app *application) serveFeed(w http.ResponseWriter, r *http.Request, contentType string, build func(base string, greetings []greeting, updated time.Time) interface{}) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	greetings, err := app.store.before(r.Context(), nil, feedSize)
+	if err != nil {
+		log.Println("feed store error:", err)
+		http.Error(w, "could not load greetings", http.StatusInternalServerError)
+		return
+	}
+	reverse(greetings)
+	var updated time.Time
+	if len(greetings) > 0 {
+		updated = greetings[0].PostDate.Truncate(time.Second)
+	} else {
+		updated = time.Unix(0, 0)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(xml.Header)
+	base := string(app.siteURL)
+	cacheControl := "public, max-age=60"
+	if base == "" {
+		base = baseURL(r)
+		cacheControl = "private, max-age=60"
+	}
+	if err := xml.NewEncoder(buf).Encode(build(base+bookPath(app.bookName()), greetings, updated)); err != nil {
+		log.Println("feed encoding error:", err)
+		http.Error(w, "could not encode feed", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", cacheControl)
+	h.Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", updated, bytes.NewReader(buf.Bytes()))
+}
+
+// baseURL returns the scheme and host that r was addressed to, such as
+// "https://example.com". The scheme is taken from the X-Forwarded-Proto header
+// if present, as set by most load balancers that terminate TLS.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+	return scheme + "://" + r.Host
+}
+
+// greetingLink returns the URL of g on the index page.
+func greetingLink(base string, g *greeting) string {
+	return base + "/#greeting-" + g.ID
+}
+
+// feedEntryID returns the ID of g's feed entries.
+func feedEntryID(g *greeting) string {
+	return feedTagPrefix + bookPath(g.Book) + "/" + g.ID
+}
+
+// siteURL is the public URL of the server, such as "https://example.com",
+// without a trailing slash. It is empty if it is not configured.
+type siteURL string
+
+// flagsSiteURL is a Wire provider function that returns the URL given by
+// -site_url.
+func flagsSiteURL(flags *cliFlags) siteURL {
+	return siteURL(strings.TrimSuffix(flags.siteURL, "/"))
+}
+
+// checkSiteURL reports whether s is suitable for -site_url.
+func checkSiteURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("-site_url: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("-site_url %q must be an http or https URL without a query", s)
+	}
+	return nil
+}
+
+// feedTitle returns a title for a feed entry with the given content.
+func feedTitle(content string) string {
+	if utf8.RuneCountInString(content) <= feedTitleLength {
+		return content
+	}
+	n := 0
+	for i := range content {
+		if n == feedTitleLength-1 {
+			return content[:i] + "…"
+		}
+		n++
+	}
+	return content
+}
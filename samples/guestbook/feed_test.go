@@ -0,0 +1,193 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFeeds(t *testing.T) {
+	ctx := context.Background()
+	store, cleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	const n = feedSize + 5
+	for i := 0; i < n; i++ {
+		if err := store.add(ctx, &greeting{Content: fmt.Sprintf("Greeting %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := newRouter(newApplication(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, ""))
+
+	get := func(target string, header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "http://guestbook.example"+target, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Atom", func(t *testing.T) {
+		w := get("/feed.atom", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/atom+xml") {
+			t.Errorf("got Content-Type %q", ct)
+		}
+		var feed atomFeed
+		if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err)
+		}
+		if len(feed.Entries) != feedSize {
+			t.Fatalf("got %d entries, want %d", len(feed.Entries), feedSize)
+		}
+		newest := feed.Entries[0]
+		if newest.Title != fmt.Sprintf("Greeting %d", n-1) {
+			t.Errorf("first entry is %q, want the newest greeting", newest.Title)
+		}
+		if !strings.HasPrefix(newest.ID, feedTagPrefix+"/") {
+			t.Errorf("got entry ID %q", newest.ID)
+		}
+		if len(newest.Links) == 0 || !strings.HasPrefix(newest.Links[0].Href, "http://guestbook.example/#greeting-") {
+			t.Errorf("got entry links %+v", newest.Links)
+		}
+		// Without -site_url, links come from the request, so shared caches
+		// must not store the feed.
+		if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private") {
+			t.Errorf("got Cache-Control %q, want private", cc)
+		}
+		if feed.Updated != newest.Updated {
+			t.Errorf("feed updated %s, want time of newest entry %s", feed.Updated, newest.Updated)
+		}
+
+		// Entry IDs are stable across requests.
+		var again atomFeed
+		if err := xml.Unmarshal(get("/feed.atom", nil).Body.Bytes(), &again); err != nil {
+			t.Fatal(err)
+		}
+		if again.Entries[0].ID != newest.ID {
+			t.Errorf("entry ID changed from %q to %q", newest.ID, again.Entries[0].ID)
+		}
+
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Fatal("no ETag")
+		}
+		if w := get("/feed.atom", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match: got status %d, want %d", w.Code, http.StatusNotModified)
+		}
+		lastModified := w.Header().Get("Last-Modified")
+		if w := get("/feed.atom", map[string]string{"If-Modified-Since": lastModified}); w.Code != http.StatusNotModified {
+			t.Errorf("If-Modified-Since: got status %d, want %d", w.Code, http.StatusNotModified)
+		}
+	})
+
+	t.Run("RSS", func(t *testing.T) {
+		w := get("/feed.rss", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		var feed rssFeed
+		if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err)
+		}
+		items := feed.Channel.Items
+		if len(items) != feedSize {
+			t.Fatalf("got %d items, want %d", len(items), feedSize)
+		}
+		if items[0].Description != fmt.Sprintf("Greeting %d", n-1) {
+			t.Errorf("first item is %q, want the newest greeting", items[0].Description)
+		}
+		if items[0].GUID.IsPermaLink || !strings.HasPrefix(items[0].GUID.ID, feedTagPrefix+"/") {
+			t.Errorf("got GUID %+v, want a tag URI", items[0].GUID)
+		}
+		if w := get("/feed.rss", map[string]string{"If-None-Match": w.Header().Get("ETag")}); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match: got status %d, want %d", w.Code, http.StatusNotModified)
+		}
+	})
+
+	t.Run("SiteURL", func(t *testing.T) {
+		router := newRouter(newApplication(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, "https://guestbook.example"))
+		var feeds [2]atomFeed
+		for i, host := range []string{"guestbook.example", "evil.example"} {
+			r := httptest.NewRequest("GET", "http://"+host+"/feed.atom", nil)
+			r.Header.Set("X-Forwarded-Proto", "http")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "public") {
+				t.Errorf("Host %s: got Cache-Control %q, want public", host, cc)
+			}
+			if err := xml.Unmarshal(w.Body.Bytes(), &feeds[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if diff := cmp.Diff(feeds[0], feeds[1]); diff != "" {
+			t.Errorf("feed depends on the Host header (-first +second):\n%s", diff)
+		}
+		for _, l := range feeds[0].Entries[0].Links {
+			if !strings.HasPrefix(l.Href, "https://guestbook.example/") {
+				t.Errorf("got link %q, want one under -site_url", l.Href)
+			}
+		}
+	})
+
+	// A new greeting changes the feed.
+	etag := get("/feed.atom", nil).Header().Get("ETag")
+	if err := store.add(ctx, &greeting{Content: "One more"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/feed.atom", map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Errorf("after new greeting: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestCheckSiteURL(t *testing.T) {
+	for _, s := range []string{"", "https://guestbook.example", "http://localhost:8080/guestbook/"} {
+		if err := checkSiteURL(s); err != nil {
+			t.Errorf("checkSiteURL(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{"guestbook.example", "ftp://guestbook.example", "https://guestbook.example/?q=1", "https:///path"} {
+		if err := checkSiteURL(s); err == nil {
+			t.Errorf("checkSiteURL(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestFeedTitle(t *testing.T) {
+	short := "Hello!"
+	if got := feedTitle(short); got != short {
+		t.Errorf("feedTitle(%q) = %q", short, got)
+	}
+	long := strings.Repeat("é", feedTitleLength+1)
+	want := strings.Repeat("é", feedTitleLength-1) + "…"
+	if got := feedTitle(long); got != want {
+		t.Errorf("feedTitle(%q) = %q, want %q", long, got, want)
+	}
+}
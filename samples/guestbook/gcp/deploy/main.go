@@ -84,6 +84,7 @@ func deploy(guestbookDir, tfStatePath string) error {
 	gby := string(gbyin)
 	replacements := map[string]string{
 		"{{IMAGE}}":             imageName,
+		"{{project}}":           tfState.Project.Value,
 		"{{bucket}}":            tfState.Bucket.Value,
 		"{{database_instance}}": tfState.DatabaseInstance.Value,
 		"{{database_region}}":   tfState.DatabaseRegion.Value,
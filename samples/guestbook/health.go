@@ -0,0 +1,98 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+// bucketCheckInterval is how often a bucketCheck checks its bucket.
+const bucketCheckInterval = 30 * time.Second
+
+// A bucketCheck is a health check for a bucket. Unlike a database connection,
+// a bucket can become inaccessible at any time (for example, if permissions
+// change), so the bucket is checked periodically in the background rather
+// than only until it first succeeds.
+type bucketCheck struct {
+	cancel  context.CancelFunc
+	stopped chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// newBucketCheck starts checking bucket every interval until Stop is called.
+func newBucketCheck(bucket *blob.Bucket, interval time.Duration) *bucketCheck {
+	// We create a context here because we are detaching.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &bucketCheck{
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+		err:     errors.New("still checking bucket"),
+	}
+	go func() {
+		defer close(c.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.check(ctx, bucket, interval)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// check checks once whether bucket is accessible and records the result.
+func (c *bucketCheck) check(ctx context.Context, bucket *blob.Bucket, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ok, err := bucket.IsAccessible(ctx)
+	if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+		// Stopped; keep the last result.
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("checking bucket: %v", err)
+	} else if !ok {
+		err = errors.New("bucket does not exist")
+	}
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+// CheckHealth implements health.Checker. It returns the result of the most
+// recent check of the bucket.
+func (c *bucketCheck) CheckHealth() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Stop stops checking the bucket.
+func (c *bucketCheck) Stop() {
+	c.cancel()
+	<-c.stopped
+}
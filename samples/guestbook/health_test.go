@@ -0,0 +1,46 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gocloud.dev/blob/memblob"
+)
+
+func TestBucketCheck(t *testing.T) {
+	bucket := memblob.OpenBucket(nil)
+	c := newBucketCheck(bucket, 10*time.Millisecond)
+	defer c.Stop()
+
+	// waitFor waits until CheckHealth reports healthy (or not).
+	waitFor := func(healthy bool) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if err := c.CheckHealth(); (err == nil) == healthy {
+				return
+			}
+		}
+		t.Fatalf("CheckHealth() = %v; want healthy = %t", c.CheckHealth(), healthy)
+	}
+	waitFor(true)
+
+	// A bucket that can no longer be read is reported as unhealthy.
+	if err := bucket.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(false)
+}
@@ -0,0 +1,43 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build wireinject
+// +build wireinject
+
+package main
+
+import (
+	"context"
+
+	"github.com/google/wire"
+	"gocloud.dev/server"
+)
+
+// This file wires the application up to the resources named by URLs in the
+// command-line flags (see resources.go). It won't be directly included in the
+// final binary, since it includes a Wire injector template function (setup),
+// but the declarations will be copied into wire_gen.go when Wire is run.
+
+// setup is a Wire injector function that sets up the application on the
+// resources named by the command-line flags.
+func setup(ctx context.Context, flags *cliFlags, drain *drainCheck) (*guestbook, func(), error) {
+	// This will be filled in by Wire with providers from the provider sets in
+	// wire.Build.
+	wire.Build(
+		server.Set,
+		applicationSet,
+		resourceSet,
+	)
+	return nil, nil, nil
+}
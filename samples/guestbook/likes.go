@@ -0,0 +1,196 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"gocloud.dev/runtimevar"
+)
+
+const (
+	// likesCookie is the name of the cookie that lists the greetings a
+	// browser has liked.
+	likesCookie = "guestbook_likes"
+	// maxCookieLikes is the number of likes remembered in the cookie. Older
+	// likes are forgotten to keep the cookie small.
+	maxCookieLikes = 50
+	// minLikeKeySize is the smallest key accepted from -like_key_var.
+	minLikeKeySize = 16
+)
+
+// A likeTracker remembers which greetings a browser has liked, in a signed
+// cookie. This keeps visitors from liking a greeting twice by accident or by
+// editing the cookie, but clearing the cookie allows liking again. A nil
+// *likeTracker doesn't remember likes.
+type likeTracker struct {
+	keyVar    *parsedVar[[]byte] // nil if the key is random
+	randomKey []byte
+}
+
+// openLikeTracker is a Wire provider function that returns a likeTracker
+// whose cookies are signed with the key in the variable named by
+// -like_key_var. If the flag is empty, a random key is used, so likes are
+// only remembered until the server restarts, and only by the server that
+// recorded them.
+func openLikeTracker(ctx context.Context, flags *cliFlags) (*likeTracker, func(), error) {
+	lt := new(likeTracker)
+	if flags.likeKeyVarURL == "" {
+		lt.randomKey = make([]byte, 32)
+		if _, err := rand.Read(lt.randomKey); err != nil {
+			return nil, nil, err
+		}
+		return lt, func() {}, nil
+	}
+	v, err := runtimevar.OpenVariable(ctx, flags.likeKeyVarURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	lt.keyVar = newParsedVar(v, "like key", parseLikeKey)
+	return lt, func() { v.Close() }, nil
+}
+
+// key returns the current key for signing cookies.
+func (lt *likeTracker) key(ctx context.Context) ([]byte, error) {
+	if lt.keyVar == nil {
+		return lt.randomKey, nil
+	}
+	return lt.keyVar.get(ctx)
+}
+
+// parseLikeKey checks a key read from -like_key_var.
+func parseLikeKey(_ context.Context, key []byte) ([]byte, error) {
+	if len(key) < minLikeKeySize {
+		return nil, fmt.Errorf("like key must be at least %d bytes", minLikeKeySize)
+	}
+	return key, nil
+}
+
+// liked returns the IDs of the greetings that r's browser has liked, oldest
+// first. A missing or invalid cookie means no likes.
+func (lt *likeTracker) liked(r *http.Request) []string {
+	if lt == nil {
+		return nil
+	}
+	c, err := r.Cookie(likesCookie)
+	if err != nil {
+		return nil
+	}
+	key, err := lt.key(r.Context())
+	if err != nil {
+		log.Println("like key error:", err)
+		return nil
+	}
+	p, s, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return nil
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !hmac.Equal(sig, signLikes(key, payload)) || len(payload) == 0 {
+		return nil
+	}
+	return strings.Split(string(payload), ",")
+}
+
+// setLiked sets the cookie to remember that the browser has liked the
+// greetings with the given IDs, oldest first.
+func (lt *likeTracker) setLiked(ctx context.Context, w http.ResponseWriter, ids []string) error {
+	if lt == nil {
+		return nil
+	}
+	if len(ids) > maxCookieLikes {
+		ids = ids[len(ids)-maxCookieLikes:]
+	}
+	key, err := lt.key(ctx)
+	if err != nil {
+		return err
+	}
+	payload := []byte(strings.Join(ids, ","))
+	http.SetCookie(w, &http.Cookie{
+		Name:     likesCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signLikes(key, payload)),
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func signLikes(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("likes|"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// like is a form action handler for liking the greeting whose ID is in the
+// "id" form field. Liking a greeting again from the same browser has no
+// effect. It redirects back to the index, sorted by likes if the "sort" form
+// field is "likes".
+func (app *application) like(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if wait := app.limiter.allow(r, actionLike); wait > 0 {
+		setRetryAfter(w, wait)
+		http.Error(w, "You are liking too often; please try again later.", http.StatusTooManyRequests)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" || strings.Contains(id, ",") {
+		http.Error(w, "missing or invalid greeting ID", http.StatusBadRequest)
+		return
+	}
+	liked := app.likes.liked(r)
+	if !slices.Contains(liked, id) {
+		err := app.store.like(r.Context(), id)
+		if errors.Is(err, errGreetingNotFound) {
+			http.Error(w, "no such greeting", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("like store error:", err)
+			http.Error(w, "could not like greeting", http.StatusInternalServerError)
+			return
+		}
+		if err := app.likes.setLiked(r.Context(), w, append(liked, id)); err != nil {
+			// The like is counted; the browser just won't remember it.
+			log.Println("like cookie error:", err)
+		}
+	}
+	next := bookPath(app.bookName()) + "/"
+	if r.FormValue("sort") == sortLikes {
+		next += "?sort=" + sortLikes
+	}
+	http.Redirect(w, r, next+"#greeting-"+id, http.StatusSeeOther)
+}
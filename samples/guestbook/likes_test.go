@@ -0,0 +1,192 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+func TestLikes(t *testing.T) {
+	ctx := context.Background()
+	store, storeCleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storeCleanup()
+	motd := constantvar.New("")
+	defer motd.Close()
+	likes, likesCleanup, err := openLikeTracker(ctx, &cliFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer likesCleanup()
+	router := newRouter(newApplication(store, nil, motd, nil, nil, nil, nil, nil, nil, nil, likes, nil, ""))
+
+	start := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	for i, g := range []*greeting{
+		{ID: "a", Content: "first"},
+		{ID: "b", Content: "second"},
+		{ID: "c", Content: "third"},
+		{ID: "p", Content: "pending", Status: statusPending},
+	} {
+		g.PostDate = start.Add(time.Duration(i) * time.Minute)
+		if err := store.add(ctx, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// like likes a greeting from a browser with the given cookies, and
+	// returns the status and the cookies the browser has afterwards.
+	like := func(id string, cookies []*http.Cookie) (int, []*http.Cookie) {
+		t.Helper()
+		form := url.Values{"id": {id}, "sort": {sortLikes}}
+		r := httptest.NewRequest("POST", "/like", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code == http.StatusSeeOther {
+			if want := "/?sort=likes#greeting-" + id; w.Header().Get("Location") != want {
+				t.Errorf("like %s: redirected to %q, want %q", id, w.Header().Get("Location"), want)
+			}
+		}
+		if set := w.Result().Cookies(); len(set) > 0 {
+			cookies = set
+		}
+		return w.Code, cookies
+	}
+	count := func(id string) int64 {
+		t.Helper()
+		g, err := store.(*docstoreGreetingStore).get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g.Likes
+	}
+
+	// One browser likes b twice and c once; the second like of b is ignored.
+	code, browser1 := like("b", nil)
+	if code != http.StatusSeeOther || len(browser1) != 1 {
+		t.Fatalf("first like: got status %d and cookies %v", code, browser1)
+	}
+	like("b", browser1)
+	_, browser1 = like("c", browser1)
+	// Other browsers like c, one of them with a forged cookie that claims
+	// it has already liked c.
+	like("c", nil)
+	forged := &http.Cookie{Name: likesCookie, Value: strings.Replace(browser1[0].Value, ".", ".x", 1)}
+	like("c", []*http.Cookie{forged})
+	if got := count("b"); got != 1 {
+		t.Errorf("b has %d likes, want 1", got)
+	}
+	if got := count("c"); got != 3 {
+		t.Errorf("c has %d likes, want 3", got)
+	}
+	if code, _ := like("p", nil); code != http.StatusNotFound {
+		t.Errorf("liking a pending greeting: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if code, _ := like("nonexistent", nil); code != http.StatusNotFound {
+		t.Errorf("liking a missing greeting: got status %d, want %d", code, http.StatusNotFound)
+	}
+
+	// The most liked greetings are listed with the most liked last, and
+	// the ones the browser liked can't be liked again.
+	r := httptest.NewRequest("GET", "/?sort=likes", nil)
+	for _, c := range browser1 {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /?sort=likes: got status %d", w.Code)
+	}
+	body := w.Body.String()
+	var ids []string
+	for _, m := range regexp.MustCompile(`id="greeting-(\w+)"`).FindAllStringSubmatch(body, -1) {
+		ids = append(ids, m[1])
+	}
+	if diff := cmp.Diff([]string{"b", "c"}, ids); diff != "" {
+		t.Errorf("most liked greetings (-want +got):\n%s", diff)
+	}
+	if n := strings.Count(body, "Liked\" disabled"); n != 2 {
+		t.Errorf("page shows %d greetings as liked, want 2", n)
+	}
+}
+
+func TestMostLiked(t *testing.T) {
+	ctx := context.Background()
+	store, cleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	start := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	for i, likes := range []int{2, 0, 5, 2, 2, 1} {
+		g := &greeting{ID: fmt.Sprintf("g%d", i), Content: "hi", PostDate: start.Add(time.Duration(i) * time.Minute)}
+		if err := store.add(ctx, g); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < likes; j++ {
+			if err := store.like(ctx, g.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	other := &greeting{ID: "other", Content: "hi"}
+	if err := store.forBook("other").add(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.forBook("other").like(ctx, other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.like(ctx, other.ID); err != errGreetingNotFound {
+		t.Errorf("liking a greeting in another book: got %v, want %v", err, errGreetingNotFound)
+	}
+
+	for _, test := range []struct {
+		limit int
+		want  []string
+	}{
+		{10, []string{"g2", "g4", "g3", "g0", "g5"}},
+		// Ties are broken by post date even when they straddle the limit.
+		{2, []string{"g2", "g4"}},
+		{3, []string{"g2", "g4", "g3"}},
+	} {
+		greetings, err := store.mostLiked(ctx, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, g := range greetings {
+			got = append(got, g.ID)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("mostLiked(%d) (-want +got):\n%s", test.limit, diff)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/server"
+	"gocloud.dev/server/health"
+)
+
+// memBase is the base URL of the guestbook started by TestMain.
+var memBase string
+
+// TestMain runs the guestbook with -env=mem on a free local port for the tests
+// to use. The server's Wire set shares one HTTP server driver, so there can be
+// only one guestbook per process.
+func TestMain(m *testing.M) {
+	shutdown, err := startMem()
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	if err := shutdown(); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(code)
+}
+
+// startMem starts the guestbook and waits for it to become ready. It sets
+// memBase and returns a function that stops the guestbook.
+func startMem() (shutdown func() error, err error) {
+	envFlag = "mem"
+	drain := newDrainCheck()
+	ctx := context.Background()
+	flags := &cliFlags{
+		greetingsURL:          "mem://greetings-TestMain/ID",
+		eventsTopicURL:        "mem://events-TestMain",
+		eventsSubscriptionURL: "mem://events-TestMain",
+	}
+	if err := resolveResources(ctx, flags); err != nil {
+		return nil, err
+	}
+	gb, cleanup, err := setup(ctx, flags, drain)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := freeAddr()
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() { errc <- serve(ctx, gb.srv, addr, drain, 0, 5*time.Second) }()
+	shutdown = func() error {
+		defer cleanup()
+		cancel()
+		return <-errc
+	}
+
+	memBase = "http://" + addr
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(memBase + "/healthz/readiness")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return shutdown, nil
+			}
+		}
+		if time.Since(start) > 5*time.Second {
+			shutdown()
+			return nil, fmt.Errorf("server did not become ready: %v", err)
+		}
+	}
+}
+
+// freeAddr returns a local address that is free to listen on.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// get fetches u and returns the response and its body.
+func get(t *testing.T, u string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestMemEnvironment(t *testing.T) {
+	base := memBase
+
+	resp, body := get(t, base+"/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	for _, want := range []string{"Guestbook - Memory", "Hello World!", `src="/blob/gophers.jpg"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /: body does not contain %q:\n%s", want, body)
+		}
+	}
+
+	// Signing redirects back to the index, which should show the greeting.
+	const msg = "Hello from the test"
+	resp, err := http.PostForm(base+"/sign", url.Values{"content": {msg}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotb, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /sign: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(string(gotb), msg) {
+		t.Errorf("POST /sign: greeting %q missing from index:\n%s", msg, gotb)
+	}
+
+	resp, err = http.PostForm(base+"/sign", url.Values{"content": {""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /sign with empty content: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// The banner is served from the preloaded bucket.
+	want, err := os.ReadFile("blobs/gophers.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body = get(t, base+"/blob/gophers.jpg")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /blob/gophers.jpg: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "image/jpeg" {
+		t.Errorf("GET /blob/gophers.jpg: got Content-Type %q, want %q", got, "image/jpeg")
+	}
+	if !bytes.Equal([]byte(body), want) {
+		t.Error("GET /blob/gophers.jpg: body does not match blobs/gophers.jpg")
+	}
+
+	resp, _ = get(t, base+"/blob/nonexistent.png")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /blob/nonexistent.png: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// postSign posts a multipart /sign form with the given content and, if
+// filename is not empty, the named file as the image.
+func postSign(t *testing.T, base, content, filename string) (*http.Response, string) {
+	t.Helper()
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	if err := mw.WriteField("content", content); err != nil {
+		t.Fatal(err)
+	}
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err := mw.CreateFormFile("image", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(base+"/sign", mw.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	gotb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(gotb)
+}
+
+func TestSignAttachment(t *testing.T) {
+	base := memBase
+
+	resp, body := postSign(t, base, "Look at these gophers", "blobs/gophers.jpg")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	m := regexp.MustCompile(`<img class="attachment" src="(/blob/attachments/[^"]+\.jpg)">`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("attachment missing from index:\n%s", body)
+	}
+	want, err := os.ReadFile("blobs/gophers.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, got := get(t, base+m[1])
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: got status %d, want %d", m[1], resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("GET %s: got Content-Type %q, want %q", m[1], ct, "image/jpeg")
+	}
+	if got != string(want) {
+		t.Errorf("GET %s: body does not match the upload", m[1])
+	}
+	if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("GET %s: got Cache-Control %q, want an immutable attachment", m[1], cc)
+	}
+
+	// Files that aren't images are rejected.
+	resp, _ = postSign(t, base, "Not an image", "blobs/motd.txt")
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("text attachment: got status %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+
+	// A form without a file is an ordinary greeting.
+	resp, body = postSign(t, base, "No picture", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("no attachment: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(body, "No picture") {
+		t.Errorf("greeting without attachment missing from index:\n%s", body)
+	}
+}
+
+func TestServeBlob(t *testing.T) {
+	ctx := context.Background()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	const content = "0123456789abcdef"
+	if err := bucket.WriteAll(ctx, "banner.txt", []byte(content), &blob.WriterOptions{
+		ContentType:  "text/plain",
+		CacheControl: "public, max-age=60",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := bucket.Attributes(ctx, "banner.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := attrs.ETag
+	lastModified := attrs.ModTime.UTC().Format(http.TimeFormat)
+	srv := httptest.NewServer(newRouter(newApplication(nil, bucket, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, "")))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		method       string
+		header       map[string]string
+		wantStatus   int
+		wantBody     string
+		contentRange string
+	}{
+		{name: "full", wantStatus: http.StatusOK, wantBody: content},
+		{name: "HEAD", method: "HEAD", wantStatus: http.StatusOK},
+		{
+			name:       "If-None-Match matches",
+			header:     map[string]string{"If-None-Match": `"other", ` + etag},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "If-Modified-Since not modified",
+			header:     map[string]string{"If-Modified-Since": lastModified},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:         "range",
+			header:       map[string]string{"Range": "bytes=2-5"},
+			wantStatus:   http.StatusPartialContent,
+			wantBody:     "2345",
+			contentRange: "bytes 2-5/16",
+		},
+		{
+			name:         "unsatisfiable range",
+			header:       map[string]string{"Range": "bytes=16-"},
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */16",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = "GET"
+			}
+			req, err := http.NewRequest(method, srv.URL+"/blob/banner.txt", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+			if got := resp.Header.Get("Content-Range"); got != test.contentRange {
+				t.Errorf("got Content-Range %q, want %q", got, test.contentRange)
+			}
+			if test.wantStatus == http.StatusRequestedRangeNotSatisfiable {
+				return
+			}
+			if got := resp.Header.Get("ETag"); got != etag {
+				t.Errorf("got ETag %q, want %q", got, etag)
+			}
+			// Last-Modified is left out of 304 responses, since there is an
+			// ETag.
+			if got := resp.Header.Get("Last-Modified"); got != lastModified && test.wantStatus != http.StatusNotModified {
+				t.Errorf("got Last-Modified %q, want %q", got, lastModified)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "public, max-age=60" {
+				t.Errorf("got Cache-Control %q, want %q", got, "public, max-age=60")
+			}
+			if string(body) != test.wantBody {
+				t.Errorf("got body %q, want %q", body, test.wantBody)
+			}
+		})
+	}
+
+	resp, err := http.Get(srv.URL + "/blob/missing.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing blob: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	// The handler for /slow blocks until release is closed.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(w, "done")
+	})
+	drain := newDrainCheck()
+	srv := server.New(mux, &server.Options{
+		HealthChecks: []health.Checker{drain},
+		// Use a driver of our own rather than the one shared with the
+		// guestbook started by TestMain.
+		Driver: server.NewDefaultDriver(),
+	})
+	addr, err := freeAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + addr
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const delay = 200 * time.Millisecond
+	errc := make(chan error, 1)
+	go func() { errc <- serve(ctx, srv, addr, drain, delay, 5*time.Second) }()
+
+	// Don't keep connections open: a spare connection dialed by the client
+	// but never used would hold up the shutdown.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	readiness := func() int {
+		resp, err := client.Get(base + "/healthz/readiness")
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for start := time.Now(); readiness() != http.StatusOK; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("server did not become ready")
+		}
+	}
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := client.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		slow <- string(b)
+	}()
+	<-started
+
+	// Once shutdown starts, readiness fails while the server still serves.
+	cancel()
+	for start := time.Now(); readiness() != http.StatusInternalServerError; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > delay {
+			t.Fatal("readiness check did not fail during shutdown")
+		}
+	}
+
+	// The in-flight request is allowed to finish.
+	select {
+	case err := <-errc:
+		t.Fatalf("serve returned %v before in-flight request finished", err)
+	case <-time.After(delay + 100*time.Millisecond):
+	}
+	close(release)
+	if got := <-slow; got != "done" {
+		t.Errorf("in-flight request: got %q, want %q", got, "done")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The database schema is defined by numbered migrations in the migrations
+// directory, with one subdirectory per SQL dialect. Migration N is a pair of
+// files, NNNN_name.up.sql and NNNN_name.down.sql, that move the schema from
+// version N-1 to N and back. Each dialect must have the same migrations. The
+// versions applied to a database are recorded in its schema_migrations table.
+//
+// schema.sql is the MySQL schema at the latest version, for provisioning
+// scripts that can only pipe SQL into the mysql client; keep it in sync.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationLockName identifies the lock held while migrating, so that
+// servers starting together don't migrate at the same time.
+const migrationLockName = "guestbook_schema_migrations"
+
+// lock takes the migration lock on conn, waiting for it if need be.
+func (d sqlDialect) lock(ctx context.Context, conn *sql.Conn) error {
+	if d == dialectPostgres {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext($1));", migrationLockName)
+		return err
+	}
+	var ok sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 300);", migrationLockName).Scan(&ok); err != nil {
+		return err
+	}
+	if ok.Int64 != 1 {
+		return fmt.Errorf("timed out waiting for lock %s", migrationLockName)
+	}
+	return nil
+}
+
+// unlock releases the migration lock on conn.
+func (d sqlDialect) unlock(ctx context.Context, conn *sql.Conn) error {
+	stmt := "SELECT RELEASE_LOCK(?);"
+	if d == dialectPostgres {
+		stmt = "SELECT pg_advisory_unlock(hashtext($1));"
+	}
+	_, err := conn.ExecContext(ctx, stmt, migrationLockName)
+	return err
+}
+
+// createMigrationsTable returns the statement that creates the
+// schema_migrations table.
+func (d sqlDialect) createMigrationsTable() string {
+	timestamp := "DATETIME"
+	if d == dialectPostgres {
+		timestamp = "TIMESTAMP"
+	}
+	return `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version BIGINT NOT NULL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at ` + timestamp + ` NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`
+}
+
+// A migration moves the database schema from version-1 to version (up) and
+// back (down).
+type migration struct {
+	version  int
+	name     string
+	up, down []string // statements
+}
+
+var migrationFileRE = regexp.MustCompile(`^(\d{4})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// loadMigrations returns the migrations for dialect, in order. It checks
+// that they are numbered from 1 without gaps and each has an up and a down
+// file.
+func loadMigrations(fsys fs.FS, dialect sqlDialect) ([]*migration, error) {
+	dir := path.Join("migrations", string(dialect))
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		m := migrationFileRE.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("%s: unexpected file %s", dir, e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &migration{version: version, name: m[2]}
+			byVersion[version] = mig
+		} else if mig.name != m[2] {
+			return nil, fmt.Errorf("%s: migration %d is named both %s and %s", dir, version, mig.name, m[2])
+		}
+		stmts := splitStatements(string(data))
+		if len(stmts) == 0 {
+			return nil, fmt.Errorf("%s: %s has no statements", dir, e.Name())
+		}
+		if m[3] == "up" {
+			mig.up = stmts
+		} else {
+			mig.down = stmts
+		}
+	}
+	migrations := make([]*migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		migrations = append(migrations, mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, mig := range migrations {
+		if mig.version != i+1 {
+			return nil, fmt.Errorf("%s: migration %d is missing", dir, i+1)
+		}
+		if mig.up == nil || mig.down == nil {
+			return nil, fmt.Errorf("%s: migration %d needs both an up and a down file", dir, mig.version)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements splits SQL into statements. Statements end with a
+// semicolon at the end of a line; lines starting with "--" are comments.
+func splitStatements(sql string) []string {
+	var stmts []string
+	var b strings.Builder
+	for _, line := range strings.Split(sql, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			stmts = append(stmts, strings.TrimSpace(b.String()))
+			b.Reset()
+		}
+	}
+	if s := strings.TrimSpace(b.String()); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
+
+// parseMigrationTarget parses the value of the -migrate flag, which is "up"
+// for the latest version or a version number. It returns -1 for "up".
+func parseMigrationTarget(s string) (int, error) {
+	if s == "up" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf(`-migrate=%s: want "up" or a schema version`, s)
+	}
+	return n, nil
+}
+
+// migrateSchema migrates the schema of db up or down to version target, or
+// to the latest version if target is -1. If the database is already at a
+// newer version than this program knows about (because a newer release has
+// migrated it), migrating up leaves it alone.
+//
+// Each migration runs in a transaction where the dialect allows. MySQL
+// commits each schema change as it is made, so if a MySQL migration fails
+// part of the way through, the database must be repaired by hand.
+func migrateSchema(ctx context.Context, db *sql.DB, dialect sqlDialect, target int) error {
+	migrations, err := loadMigrations(migrationFiles, dialect)
+	if err != nil {
+		return err
+	}
+	latest := len(migrations)
+	if target > latest {
+		return fmt.Errorf("no schema version %d; the latest is %d", target, latest)
+	}
+	up := target < 0
+	if up {
+		target = latest
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := dialect.lock(ctx, conn); err != nil {
+		return fmt.Errorf("locking schema migrations: %v", err)
+	}
+	defer func() {
+		if err := dialect.unlock(context.Background(), conn); err != nil {
+			log.Println("unlocking schema migrations:", err)
+		}
+	}()
+	if _, err := conn.ExecContext(ctx, dialect.createMigrationsTable()); err != nil {
+		return fmt.Errorf("creating schema_migrations: %v", err)
+	}
+	var current int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations;").Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %v", err)
+	}
+	if current > latest {
+		if up {
+			log.Printf("Database schema is at version %d, newer than this program's %d; not migrating", current, latest)
+			return nil
+		}
+		return fmt.Errorf("database schema is at version %d, newer than this program's %d; migrate it with a newer release", current, latest)
+	}
+	if current == target {
+		log.Printf("Database schema is at version %d", current)
+		return nil
+	}
+	for current < target {
+		mig := migrations[current]
+		record := dialect.rebind("INSERT INTO schema_migrations (version, name) VALUES (?, ?);")
+		if err := runMigration(ctx, conn, dialect, mig.up, record, mig.version, mig.name); err != nil {
+			return fmt.Errorf("migrating up to version %d (%s): %v", mig.version, mig.name, err)
+		}
+		log.Printf("Migrated database schema up to version %d (%s)", mig.version, mig.name)
+		current++
+	}
+	for current > target {
+		mig := migrations[current-1]
+		record := dialect.rebind("DELETE FROM schema_migrations WHERE version = ?;")
+		if err := runMigration(ctx, conn, dialect, mig.down, record, mig.version); err != nil {
+			return fmt.Errorf("migrating down from version %d (%s): %v", mig.version, mig.name, err)
+		}
+		log.Printf("Migrated database schema down to version %d", mig.version-1)
+		current--
+	}
+	return nil
+}
+
+// runMigration runs stmts followed by record, which records the change in
+// schema_migrations, in a transaction unless the dialect is MySQL.
+func runMigration(ctx context.Context, conn *sql.Conn, dialect sqlDialect, stmts []string, record string, args ...interface{}) error {
+	if dialect == dialectMySQL {
+		for _, stmt := range stmts {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		_, err := conn.ExecContext(ctx, record, args...)
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
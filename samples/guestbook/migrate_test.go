@@ -0,0 +1,118 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMigrations(t *testing.T) {
+	mysql, err := loadMigrations(migrationFiles, dialectMySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := loadMigrations(migrationFiles, dialectPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(migrations []*migration) []string {
+		var names []string
+		for _, m := range migrations {
+			names = append(names, fmt.Sprintf("%d_%s", m.version, m.name))
+		}
+		return names
+	}
+	if diff := cmp.Diff(names(mysql), names(postgres)); diff != "" {
+		t.Errorf("MySQL and Postgres migrations differ (-mysql +postgres):\n%s", diff)
+	}
+
+	// schema.sql must record all the MySQL migrations.
+	schema, err := os.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded []string
+	for _, m := range regexp.MustCompile(`\((\d+), '(\w+)'\)`).FindAllStringSubmatch(string(schema), -1) {
+		recorded = append(recorded, m[1]+"_"+m[2])
+	}
+	if diff := cmp.Diff(names(mysql), recorded); diff != "" {
+		t.Errorf("schema.sql is out of date with migrations/mysql (-migrations +schema.sql):\n%s", diff)
+	}
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("SELECT 1;\n")}
+	for _, test := range []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"gap", []string{"0001_a.up.sql", "0001_a.down.sql", "0003_c.up.sql", "0003_c.down.sql"}, "migration 2 is missing"},
+		{"no down", []string{"0001_a.up.sql"}, "needs both"},
+		{"renamed", []string{"0001_a.up.sql", "0001_b.down.sql"}, "named both"},
+		{"stray file", []string{"0001_a.up.sql", "0001_a.down.sql", "README"}, "unexpected file"},
+	} {
+		fsys := make(fstest.MapFS)
+		for _, f := range test.files {
+			fsys["migrations/mysql/"+f] = file
+		}
+		if _, err := loadMigrations(fsys, dialectMySQL); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	const sql = `-- A comment; with a semicolon.
+CREATE INDEX i ON t (a);
+ALTER TABLE t
+    ADD COLUMN b INT NOT NULL DEFAULT 0; 
+
+DROP INDEX j`
+	want := []string{
+		"CREATE INDEX i ON t (a);",
+		"ALTER TABLE t\n    ADD COLUMN b INT NOT NULL DEFAULT 0;",
+		"DROP INDEX j",
+	}
+	if diff := cmp.Diff(want, splitStatements(sql)); diff != "" {
+		t.Errorf("splitStatements (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseMigrationTarget(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"up", -1, false},
+		{"0", 0, false},
+		{"3", 3, false},
+		{"-1", 0, true},
+		{"down", 0, true},
+	} {
+		got, err := parseMigrationTarget(test.in)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("parseMigrationTarget(%q) = %d, %v; want %d, error %t", test.in, got, err, test.want, test.wantErr)
+		}
+	}
+}
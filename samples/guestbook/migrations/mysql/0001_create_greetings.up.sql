@@ -0,0 +1,21 @@
+-- Copyright 2024 The Go Cloud Development Kit Authors
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--     https://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- IF NOT EXISTS adopts databases created before migrations were tracked.
+CREATE TABLE IF NOT EXISTS greetings (
+    content VARCHAR(255) CHARACTER SET utf8
+        NOT NULL
+        CHECK (content <> ''),
+    post_date DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,206 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+
+	"gocloud.dev/pubsub"
+	_ "gocloud.dev/pubsub/awssnssqs"
+	_ "gocloud.dev/pubsub/azuresb"
+	_ "gocloud.dev/pubsub/gcppubsub"
+	_ "gocloud.dev/pubsub/mempubsub"
+)
+
+// A moderationQueue receives greetings that await moderation. When the
+// guestbook runs in moderation mode, new greetings are stored as pending and
+// published to the queue's topic, so that moderators (or other services) can
+// be notified of them. Moderators approve or reject pending greetings on the
+// /admin/moderate page.
+//
+// A nil *moderationQueue means moderation is disabled.
+type moderationQueue struct {
+	topic *pubsub.Topic
+}
+
+// openModerationQueue is a Wire provider function that opens the moderation
+// topic named by the command-line flags. It returns nil, disabling
+// moderation, if no topic is configured.
+func openModerationQueue(ctx context.Context, flags *cliFlags) (*moderationQueue, func(), error) {
+	if flags.moderationTopicURL == "" {
+		return nil, func() {}, nil
+	}
+	topic, err := pubsub.OpenTopic(ctx, flags.moderationTopicURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &moderationQueue{topic: topic}, func() { topic.Shutdown(context.Background()) }, nil
+}
+
+// publish sends g to the moderation topic. The message body is the JSON
+// representation used by the API.
+func (q *moderationQueue) publish(ctx context.Context, g *greeting) error {
+	body, err := json.Marshal(newAPIGreeting(g))
+	if err != nil {
+		return err
+	}
+	return q.topic.Send(ctx, &pubsub.Message{
+		Body:     body,
+		Metadata: map[string]string{"id": g.ID},
+	})
+}
+
+// addGreeting stores a new greeting and sends it to the visitors watching for
+// live updates. In moderation mode, the greeting is held as pending and
+// published to the moderation topic instead of being shown right away.
+func (app *application) addGreeting(ctx context.Context, g *greeting) error {
+	if app.moderation != nil {
+		g.Status = statusPending
+	}
+	if err := app.store.add(ctx, g); err != nil {
+		return err
+	}
+	if app.moderation != nil {
+		if err := app.moderation.publish(ctx, g); err != nil {
+			// The greeting is stored, so moderators can still find it on
+			// the moderation page.
+			log.Printf("publishing greeting %s for moderation: %v", g.ID, err)
+		}
+	}
+	if g.visible() {
+		app.publishEvent(ctx, g)
+	}
+	return nil
+}
+
+// publishEvent sends g, which has just become visible, to the visitors
+// watching for live updates.
+func (app *application) publishEvent(ctx context.Context, g *greeting) {
+	if app.eventHub == nil {
+		return
+	}
+	if err := app.eventHub.publish(ctx, g); err != nil {
+		// Visitors will see the greeting when they reload.
+		log.Printf("publishing greeting %s event: %v", g.ID, err)
+	}
+}
+
+// moderate serves the moderation page, which lists the pending greetings and
+// lets a moderator approve or reject each of them.
+func (app *application) moderate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var status string
+		switch r.FormValue("decision") {
+		case "approve":
+			status = statusApproved
+		case "reject":
+			status = statusRejected
+		default:
+			http.Error(w, "decision must be approve or reject", http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		g, err := app.store.setStatus(ctx, r.FormValue("id"), statusPending, status)
+		if err == errGreetingNotFound {
+			http.Error(w, "no such pending greeting", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("moderate store error:", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if status == statusApproved {
+			app.publishEvent(ctx, g)
+		} else if g.Attachment != "" {
+			app.deleteAttachment(ctx, g.Attachment)
+		}
+		app.audit.record(r.Context(), &auditEntry{User: adminUser(r), Action: r.FormValue("decision") + " greeting", Book: app.bookName(), Target: r.FormValue("id")})
+		http.Redirect(w, r, bookPath(app.bookName())+"/admin/moderate", http.StatusSeeOther)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Only GET and POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		Title     string
+		Prefix    string
+		Enabled   bool
+		Greetings []greeting
+	}
+	data.Title = app.title()
+	data.Prefix = bookPath(app.bookName())
+	data.Enabled = app.moderation != nil
+	var err error
+	data.Greetings, err = app.store.pending(r.Context(), greetingsPerPage)
+	if err != nil {
+		log.Println("moderate store error:", err)
+		http.Error(w, "could not load greetings", http.StatusInternalServerError)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err := moderateTmpl.Execute(buf, data); err != nil {
+		log.Println("template error:", err)
+		http.Error(w, "could not render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Println("writing response:", err)
+	}
+}
+
+var moderateTmpl = template.Must(template.New("moderate.html").Parse(`<!DOCTYPE html>
+<title>{{.Title}} - Moderation</title>
+<style type="text/css">
+html, body {
+	font-family: Helvetica, sans-serif;
+}
+blockquote {
+	font-family: cursive, Helvetica, sans-serif;
+}
+.attachment {
+	max-height: 200px;
+	max-width: 300px;
+}
+</style>
+<h1>Pending greetings</h1>
+{{if not .Enabled}}<p>Moderation is disabled, so new greetings are shown right away.</p>{{end}}
+{{range .Greetings}}
+<div class="greeting">
+	Someone wrote on {{.PostDate.Format "2006-01-02 15:04"}}:
+	<blockquote>{{.Content}}</blockquote>
+	{{with .Attachment}}<img class="attachment" src="{{$.Prefix}}/blob/{{.}}">{{end}}
+	<form action="{{$.Prefix}}/admin/moderate" method="POST">
+		<input type="hidden" name="id" value="{{.ID}}">
+		<button type="submit" name="decision" value="approve">Approve</button>
+		<button type="submit" name="decision" value="reject">Reject</button>
+	</form>
+</div>
+{{else}}
+<p>No greetings are waiting for moderation.</p>
+{{end}}
+`))
@@ -0,0 +1,169 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/docstore"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+func TestModeration(t *testing.T) {
+	ctx := context.Background()
+	const topicURL = "mem://moderation-TestModeration"
+	queue, cleanup, err := openModerationQueue(ctx, &cliFlags{moderationTopicURL: topicURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sub, err := pubsub.OpenSubscription(ctx, topicURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Shutdown(ctx)
+	store, storeCleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storeCleanup()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	motd := constantvar.New("")
+	defer motd.Close()
+	hub := &eventHub{clients: make(map[chan []byte]string)}
+	events, unsubscribe := hub.subscribe("")
+	defer unsubscribe()
+	router := newRouter(newApplication(store, bucket, motd, queue, nil, hub, nil, &adminAuth{}, nil, nil, nil, nil, ""))
+
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.RemoteAddr = "127.0.0.1:1234" // admin pages are open to local clients with -insecure_local_admin
+		if form != nil {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	// sign posts a greeting and returns its ID from the moderation message.
+	sign := func(content string) string {
+		t.Helper()
+		w := do("POST", "/sign", url.Values{"content": {content}})
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/?pending=1" {
+			t.Fatalf("POST /sign: got %d to %q, want %d to /?pending=1", w.Code, w.Header().Get("Location"), http.StatusSeeOther)
+		}
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Ack()
+		var g apiGreeting
+		if err := json.Unmarshal(msg.Body, &g); err != nil {
+			t.Fatal(err)
+		}
+		if g.Content != content || g.Status != statusPending || msg.Metadata["id"] != g.ID {
+			t.Fatalf("got moderation message %+v (metadata %v), want pending greeting %q", g, msg.Metadata, content)
+		}
+		return g.ID
+	}
+	shown := func(content string) bool {
+		t.Helper()
+		w := do("GET", "/", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /: got status %d, want %d", w.Code, http.StatusOK)
+		}
+		return strings.Contains(w.Body.String(), content)
+	}
+
+	goodID := sign("A lovely party")
+	badID := sign("Buy cheap watches")
+	// Attachments can only be uploaded with a multipart form, so give the
+	// rejected greeting one directly.
+	const attachment = "attachments/watches.png"
+	if err := bucket.WriteAll(ctx, attachment, []byte("not really a PNG"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.(*docstoreGreetingStore).coll.Update(ctx, &greeting{ID: badID}, docstore.Mods{"Attachment": attachment}); err != nil {
+		t.Fatal(err)
+	}
+	if shown("A lovely party") || shown("Buy cheap watches") {
+		t.Error("pending greetings are shown on the index")
+	}
+	w := do("GET", "/admin/moderate", nil)
+	for _, content := range []string{"A lovely party", "Buy cheap watches"} {
+		if !strings.Contains(w.Body.String(), content) {
+			t.Errorf("moderation page does not list pending greeting %q", content)
+		}
+	}
+
+	for id, decision := range map[string]string{goodID: "approve", badID: "reject"} {
+		w := do("POST", "/admin/moderate", url.Values{"id": {id}, "decision": {decision}})
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("%s %s: got status %d, want %d", decision, id, w.Code, http.StatusSeeOther)
+		}
+	}
+	if !shown("A lovely party") {
+		t.Error("approved greeting is not shown on the index")
+	}
+	if shown("Buy cheap watches") {
+		t.Error("rejected greeting is shown on the index")
+	}
+	if exists, err := bucket.Exists(ctx, attachment); err != nil || exists {
+		t.Errorf("attachment of rejected greeting: Exists = %t, %v; want it deleted", exists, err)
+	}
+	// Only the approved greeting is sent to live viewers.
+	select {
+	case data := <-events:
+		var g apiGreeting
+		if err := json.Unmarshal(data, &g); err != nil {
+			t.Fatal(err)
+		}
+		if g.ID != goodID || g.Status != statusApproved {
+			t.Errorf("got event for greeting %s (%s), want approved greeting %s", g.ID, g.Status, goodID)
+		}
+	default:
+		t.Error("approved greeting was not sent to live viewers")
+	}
+	select {
+	case data := <-events:
+		t.Errorf("got unexpected event %s", data)
+	default:
+	}
+	pending, err := store.pending(ctx, greetingsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("got %d pending greetings after moderation, want 0", len(pending))
+	}
+
+	// A greeting can be moderated only once.
+	if w := do("POST", "/admin/moderate", url.Values{"id": {badID}, "decision": {"approve"}}); w.Code != http.StatusNotFound {
+		t.Errorf("approving a rejected greeting: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do("POST", "/admin/moderate", url.Values{"id": {goodID}, "decision": {"maybe"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown decision: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
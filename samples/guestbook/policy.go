@@ -0,0 +1,269 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gocloud.dev/runtimevar"
+	_ "gocloud.dev/runtimevar/awsparamstore"
+	_ "gocloud.dev/runtimevar/constantvar"
+	_ "gocloud.dev/runtimevar/filevar"
+	_ "gocloud.dev/runtimevar/gcpruntimeconfig"
+	_ "gocloud.dev/runtimevar/httpvar"
+)
+
+// contentPolicy is a set of rules for the content of new greetings, in
+// addition to those checked by validateContent. It is read from a runtimevar
+// as JSON, for example:
+//
+//	{
+//	  "banned_words": ["spam", "scam"],
+//	  "max_length": 140,
+//	  "rules": [
+//	    {"pattern": "https?://", "message": "links are not allowed"}
+//	  ]
+//	}
+type contentPolicy struct {
+	// BannedWords are rejected wherever they appear as whole words,
+	// ignoring case.
+	BannedWords []string `json:"banned_words"`
+	// MaxLength, if positive, is the maximum greeting length in characters.
+	MaxLength int `json:"max_length"`
+	// Rules reject greetings that match any of their patterns.
+	Rules []policyRule `json:"rules"`
+
+	bannedRE *regexp.Regexp // matches any of BannedWords; nil if none
+}
+
+// policyRule rejects greetings matching Pattern, a regular expression in the
+// syntax of the regexp package. Message is shown to the visitor; if empty, a
+// generic message is used.
+type policyRule struct {
+	Pattern string `json:"pattern"`
+	Message string `json:"message"`
+
+	re *regexp.Regexp
+}
+
+// parsePolicy decodes and compiles a JSON content policy.
+func parsePolicy(data []byte) (*contentPolicy, error) {
+	p := new(contentPolicy)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("decoding content policy: %v", err)
+	}
+	if p.MaxLength < 0 {
+		return nil, errors.New("content policy: max_length must not be negative")
+	}
+	var words []string
+	for _, w := range p.BannedWords {
+		if w = strings.TrimSpace(w); w != "" {
+			words = append(words, wordPattern(w))
+		}
+	}
+	if len(words) > 0 {
+		p.bannedRE = regexp.MustCompile(`(?i)(?:` + strings.Join(words, "|") + `)`)
+	}
+	for i := range p.Rules {
+		re, err := regexp.Compile(p.Rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("content policy: rule %d: %v", i, err)
+		}
+		p.Rules[i].re = re
+	}
+	return p, nil
+}
+
+// wordPattern returns a regular expression matching w as a whole word. A word
+// boundary is only required next to letters and digits, so that words such as
+// "c++" also match.
+func wordPattern(w string) string {
+	re := regexp.QuoteMeta(w)
+	if r, _ := utf8.DecodeRuneInString(w); isWordRune(r) {
+		re = `\b` + re
+	}
+	if r, _ := utf8.DecodeLastRuneInString(w); isWordRune(r) {
+		re += `\b`
+	}
+	return re
+}
+
+// isWordRune reports whether r is a word character as understood by \b.
+func isWordRune(r rune) bool {
+	return r == '_' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+// check returns an error, suitable to show to the visitor, if content
+// violates the policy.
+func (p *contentPolicy) check(content string) error {
+	if p.MaxLength > 0 && utf8.RuneCountInString(content) > p.MaxLength {
+		return fmt.Errorf("content must be at most %d characters", p.MaxLength)
+	}
+	if p.bannedRE != nil && p.bannedRE.MatchString(content) {
+		return errors.New("content contains a banned word")
+	}
+	for _, r := range p.Rules {
+		if r.re.MatchString(content) {
+			if r.Message != "" {
+				return errors.New(r.Message)
+			}
+			return errors.New("content is not allowed")
+		}
+	}
+	return nil
+}
+
+// A parsedVar holds the value of a runtimevar read with the bytes or string
+// decoder and parsed by parse. The data is parsed again whenever the variable
+// changes. If a change cannot be parsed, the error is logged and the last good
+// value stays in force, so that a bad push cannot, for example, switch off a
+// filter. Bad data is parsed again after parseRetryInterval, in case parse
+// failed for a reason other than the data.
+type parsedVar[T any] struct {
+	v     *runtimevar.Variable
+	what  string // what the variable holds, for messages
+	parse func(ctx context.Context, data []byte) (T, error)
+
+	mu      sync.Mutex
+	raw     []byte    // data current was parsed from
+	current T         // last good value
+	loaded  bool      // whether current has been set
+	parsing bool      // whether a request is parsing new data
+	bad     []byte    // data that last failed to parse
+	badErr  error     // why bad failed to parse
+	badTime time.Time // when bad failed to parse
+}
+
+// parseRetryInterval is how long a parsedVar waits before parsing bad data
+// again.
+const parseRetryInterval = time.Minute
+
+// newParsedVar returns a parsedVar for v. what describes the value of v in
+// messages, such as "content policy".
+func newParsedVar[T any](v *runtimevar.Variable, what string, parse func(ctx context.Context, data []byte) (T, error)) *parsedVar[T] {
+	return &parsedVar[T]{v: v, what: what, parse: parse}
+}
+
+// get returns the last good value of the variable.
+func (pv *parsedVar[T]) get(ctx context.Context) (T, error) {
+	var zero T
+	snap, err := pv.v.Latest(ctx)
+	if err != nil {
+		return zero, err
+	}
+	var raw []byte
+	switch v := snap.Value.(type) {
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return zero, fmt.Errorf("%s variable has type %T; want the bytes or string decoder", pv.what, snap.Value)
+	}
+
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+	if pv.loaded && bytes.Equal(raw, pv.raw) {
+		return pv.current, nil
+	}
+	retry := pv.bad == nil || !bytes.Equal(raw, pv.bad) || time.Since(pv.badTime) >= parseRetryInterval
+	// Parsing may be slow, as when it decrypts through a KMS, so it is done
+	// without holding mu. Once a good value is loaded, other requests keep
+	// using it while one request parses the new data.
+	if retry && (!pv.loaded || !pv.parsing) {
+		pv.parsing = true
+		pv.mu.Unlock()
+		val, err := pv.parse(ctx, raw)
+		pv.mu.Lock()
+		pv.parsing = false
+		if err == nil {
+			pv.raw, pv.current, pv.loaded, pv.bad, pv.badErr = raw, val, true, nil, nil
+			return val, nil
+		}
+		log.Printf("ignoring bad %s: %v", pv.what, err)
+		pv.bad, pv.badErr, pv.badTime = raw, err, time.Now()
+	}
+	if !pv.loaded {
+		return zero, fmt.Errorf("no valid %s loaded: %v", pv.what, pv.badErr)
+	}
+	return pv.current, nil
+}
+
+// A contentFilter enforces the content policy held in a runtimevar.
+//
+// A nil *contentFilter allows all content.
+type contentFilter struct {
+	policies *parsedVar[*contentPolicy]
+}
+
+// openContentFilter is a Wire provider function that opens the content
+// policy variable named by the command-line flags. It returns nil, disabling
+// the filter, if no variable is configured.
+func openContentFilter(ctx context.Context, flags *cliFlags) (*contentFilter, func(), error) {
+	if flags.policyVarURL == "" {
+		return nil, func() {}, nil
+	}
+	v, err := runtimevar.OpenVariable(ctx, flags.policyVarURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	parse := func(_ context.Context, data []byte) (*contentPolicy, error) { return parsePolicy(data) }
+	return &contentFilter{policies: newParsedVar(v, "content policy", parse)}, func() { v.Close() }, nil
+}
+
+// policy returns the content policy to enforce.
+func (f *contentFilter) policy(ctx context.Context) (*contentPolicy, error) {
+	return f.policies.get(ctx)
+}
+
+// checkContent reports whether content is acceptable as the text of a new
+// greeting, applying both validateContent and the content policy, if any. If
+// the content is rejected, the returned error is a *contentError.
+func (app *application) checkContent(ctx context.Context, content string) error {
+	if err := validateContent(content); err != nil {
+		return &contentError{err}
+	}
+	if app.filter == nil {
+		return nil
+	}
+	p, err := app.filter.policy(ctx)
+	if err != nil {
+		return err
+	}
+	if err := p.check(content); err != nil {
+		return &contentError{err}
+	}
+	return nil
+}
+
+// contentError is returned by checkContent for content that is rejected, as
+// opposed to a failure to load the policy.
+type contentError struct {
+	err error
+}
+
+func (e *contentError) Error() string { return e.err.Error() }
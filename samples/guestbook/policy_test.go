@@ -0,0 +1,159 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+func TestContentPolicy(t *testing.T) {
+	p, err := parsePolicy([]byte(`{
+		"banned_words": ["spam", "c++"],
+		"max_length": 20,
+		"rules": [
+			{"pattern": "https?://", "message": "links are not allowed"},
+			{"pattern": "^[A-Z ]+$"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		content string
+		want    string // empty if the content is allowed
+	}{
+		{"Hello, world!", ""},
+		{"Spamalot was great", ""},
+		{"Eat SPAM today", "content contains a banned word"},
+		{"I like c++.", "content contains a banned word"},
+		{"abc++", ""},
+		{"This is much too long", "content must be at most 20 characters"},
+		{"see http://x.test", "links are not allowed"},
+		{"STOP SHOUTING", "content is not allowed"},
+	} {
+		got := ""
+		if err := p.check(test.content); err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("check(%q) = %q, want %q", test.content, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"max_length": -1}`,
+		`{"rules": [{"pattern": "("}]}`,
+		`{"banned": ["typo"]}`,
+	} {
+		if _, err := parsePolicy([]byte(bad)); err == nil {
+			t.Errorf("parsePolicy(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestContentFilterReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"banned_words": ["spam"]}`)
+	f, cleanup, err := openContentFilter(ctx, &cliFlags{policyVarURL: "file://" + filepath.ToSlash(path) + "?wait=10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// waitFor waits until the variable holds data.
+	waitFor := func(data string) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			snap, err := f.policies.v.Latest(ctx)
+			if err == nil && bytes.Equal(snap.Value.([]byte), []byte(data)) {
+				return
+			}
+		}
+		t.Fatalf("variable was not updated to %q", data)
+	}
+	banned := func(content string) bool {
+		t.Helper()
+		p, err := f.policy(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.check(content) != nil
+	}
+
+	if !banned("spam") {
+		t.Error("initial policy: spam is allowed")
+	}
+
+	const tighter = `{"banned_words": ["spam", "eggs"]}`
+	write(tighter)
+	waitFor(tighter)
+	if !banned("eggs") {
+		t.Error("after update: eggs are allowed")
+	}
+
+	// A bad update leaves the last good policy in force.
+	const bad = `{"banned_words": ["spam", `
+	write(bad)
+	waitFor(bad)
+	if !banned("spam") || !banned("eggs") {
+		t.Error("after bad update: last good policy is not enforced")
+	}
+}
+
+func TestParsedVarParsesWithoutLock(t *testing.T) {
+	ctx := context.Background()
+	v := constantvar.New("new")
+	defer v.Close()
+	started, release := make(chan struct{}), make(chan struct{})
+	pv := newParsedVar(v, "test value", func(_ context.Context, data []byte) (string, error) {
+		close(started)
+		<-release // a slow parse, as through a KMS
+		return string(data), nil
+	})
+	pv.raw, pv.current, pv.loaded = []byte("old"), "old", true
+
+	done := make(chan string)
+	go func() {
+		val, _ := pv.get(ctx)
+		done <- val
+	}()
+	<-started
+	// Other requests keep using the last good value meanwhile.
+	if val, err := pv.get(ctx); err != nil || val != "old" {
+		t.Errorf("get while parsing: got %q, %v, want old", val, err)
+	}
+	close(release)
+	if val := <-done; val != "new" {
+		t.Errorf("get that parsed: got %q, want new", val)
+	}
+	if val, err := pv.get(ctx); err != nil || val != "new" {
+		t.Errorf("get after parsing: got %q, %v, want new", val, err)
+	}
+}
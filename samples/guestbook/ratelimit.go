@@ -0,0 +1,375 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/runtimevar"
+)
+
+// rateLimits are the limits on how often a client may sign a guestbook. They
+// are read from a runtimevar as JSON, for example:
+//
+//	{"per_minute": 6, "burst": 3}
+//
+// Each client has a token bucket that holds up to Burst tokens and is
+// refilled at PerMinute tokens a minute; signing takes a token.
+type rateLimits struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     float64 `json:"burst"`
+}
+
+// parseRateLimits decodes JSON rate limits.
+func parseRateLimits(data []byte) (*rateLimits, error) {
+	l := new(rateLimits)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(l); err != nil {
+		return nil, fmt.Errorf("decoding rate limits: %v", err)
+	}
+	if l.PerMinute <= 0 {
+		return nil, errors.New("rate limits: per_minute must be positive")
+	}
+	if l.Burst < 1 {
+		return nil, errors.New("rate limits: burst must be at least 1")
+	}
+	return l, nil
+}
+
+// A rateBucket is the token bucket of one client.
+type rateBucket struct {
+	Key     string
+	Tokens  float64
+	Updated time.Time
+
+	DocstoreRevision interface{}
+}
+
+// take refills b for the time since it was last updated and takes a token
+// for a request at now. It returns 0 if the request is allowed, or how long
+// the client must wait before there is a token for it.
+func (b *rateBucket) take(l *rateLimits, now time.Time) time.Duration {
+	rate := l.PerMinute / 60 // tokens per second
+	if b.Updated.IsZero() {
+		b.Tokens = l.Burst
+	} else if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens += elapsed * rate
+	}
+	// Replicas' clocks may disagree; never move the bucket back in time.
+	if now.After(b.Updated) {
+		b.Updated = now
+	}
+	b.Tokens = math.Min(b.Tokens, l.Burst)
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return 0
+	}
+	// Round away floating-point noise, but never to 0, which would mean the
+	// request is allowed.
+	wait := time.Duration(math.Round((1-b.Tokens)/rate*1000)) * time.Millisecond
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// A rateLimitStore holds the clients' token buckets.
+type rateLimitStore interface {
+	// take takes a token from the bucket of the client with the given key,
+	// as rateBucket.take does.
+	take(ctx context.Context, key string, l *rateLimits, now time.Time) (time.Duration, error)
+}
+
+// memRateLimitStore keeps token buckets in memory, so each server instance
+// limits clients separately. Full buckets are the same as no bucket, so they
+// are swept away periodically to keep the map from growing with every client
+// ever seen.
+type memRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	limits  *rateLimits // the limits of the latest take, used to sweep
+}
+
+// memRateLimitSweepInterval is how often a memRateLimitStore forgets its full
+// buckets.
+const memRateLimitSweepInterval = time.Minute
+
+// newMemRateLimitStore returns an empty memRateLimitStore and a function that
+// stops sweeping it.
+func newMemRateLimitStore() (*memRateLimitStore, func()) {
+	s := &memRateLimitStore{buckets: make(map[string]*rateBucket)}
+	ticker := time.NewTicker(memRateLimitSweepInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case now := <-ticker.C:
+				s.sweep(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return s, func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+func (s *memRateLimitStore) take(ctx context.Context, key string, l *rateLimits, now time.Time) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+	b := s.buckets[key]
+	if b == nil {
+		b = &rateBucket{Key: key}
+		s.buckets[key] = b
+	}
+	return b.take(l, now), nil
+}
+
+// sweep deletes the buckets that have refilled by now.
+func (s *memRateLimitStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.limits
+	if l == nil {
+		return
+	}
+	for k, b := range s.buckets {
+		if now.Sub(b.Updated).Seconds()*l.PerMinute/60+b.Tokens >= l.Burst {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+// docstoreRateLimitStore keeps token buckets in a docstore collection keyed
+// by Key, so that all server instances share them. Concurrent updates are
+// detected with revisions and retried.
+type docstoreRateLimitStore struct {
+	coll *docstore.Collection
+}
+
+// rateLimitAttempts is the number of times a docstoreRateLimitStore tries to
+// update a bucket that other requests are also updating.
+const rateLimitAttempts = 5
+
+func (s *docstoreRateLimitStore) take(ctx context.Context, key string, l *rateLimits, now time.Time) (time.Duration, error) {
+	for i := 0; ; i++ {
+		b := &rateBucket{Key: key}
+		err := s.coll.Get(ctx, b)
+		exists := err == nil
+		if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return 0, err
+		}
+		wait := b.take(l, now)
+		if exists {
+			err = s.coll.Replace(ctx, b)
+		} else {
+			err = s.coll.Create(ctx, b)
+		}
+		if err == nil {
+			return wait, nil
+		}
+		code := gcerrors.Code(err)
+		if (code != gcerrors.FailedPrecondition && code != gcerrors.AlreadyExists) || i+1 == rateLimitAttempts {
+			return 0, err
+		}
+	}
+}
+
+// Actions that are rate limited. Each client has a token bucket per action,
+// so that liking greetings doesn't use up the client's signatures.
+const (
+	actionSign = "sign"
+	actionLike = "like"
+)
+
+// A rateLimiter limits how often each client may sign or like, with the
+// limits held in a runtimevar. As with a contentFilter, a change to the
+// limits that cannot be parsed is logged and the last good limits stay in
+// force.
+//
+// A nil *rateLimiter does not limit clients.
+type rateLimiter struct {
+	limitsVar      *parsedVar[*rateLimits]
+	store          rateLimitStore
+	trustedProxies []*net.IPNet
+}
+
+// openRateLimiter is a Wire provider function that opens the rate limits
+// variable and, if one is named, the docstore collection of token buckets
+// given by the command-line flags. It returns nil, disabling rate limiting,
+// if no variable is configured.
+func openRateLimiter(ctx context.Context, flags *cliFlags) (*rateLimiter, func(), error) {
+	if flags.rateLimitVarURL == "" {
+		return nil, func() {}, nil
+	}
+	trusted, err := parseTrustedProxies(flags.trustedProxies)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := runtimevar.OpenVariable(ctx, flags.rateLimitVarURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	parse := func(_ context.Context, data []byte) (*rateLimits, error) { return parseRateLimits(data) }
+	l := &rateLimiter{limitsVar: newParsedVar(v, "rate limits", parse), trustedProxies: trusted}
+	if flags.rateLimitURL == "" {
+		store, stop := newMemRateLimitStore()
+		l.store = store
+		return l, func() {
+			stop()
+			v.Close()
+		}, nil
+	}
+	coll, err := docstore.OpenCollection(ctx, flags.rateLimitURL)
+	if err != nil {
+		v.Close()
+		return nil, nil, err
+	}
+	l.store = &docstoreRateLimitStore{coll: coll}
+	return l, func() {
+		coll.Close()
+		v.Close()
+	}, nil
+}
+
+// allow takes a token for action from the client making r. It returns 0
+// if the request is allowed, or how long the client must wait before trying
+// again. If the limits or the client's bucket can't be loaded, the failure
+// is logged and the request is allowed, so that an outage of the limits'
+// backends doesn't stop visitors from signing.
+func (l *rateLimiter) allow(r *http.Request, action string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	limits, err := l.limitsVar.get(r.Context())
+	if err != nil {
+		log.Println("rate limits unavailable:", err)
+		return 0
+	}
+	ip := clientIP(r, l.trustedProxies)
+	if ip == nil {
+		return 0
+	}
+	wait, err := l.store.take(r.Context(), action+":"+rateLimitKey(ip), limits, time.Now())
+	if err != nil {
+		log.Println("rate limit store error:", err)
+		return 0
+	}
+	return wait
+}
+
+// rateLimitKey returns the key of the token bucket for a client at ip. IPv6
+// clients are usually given a whole /64, so they are limited by it, keyed by
+// the prefix in hex: keys become document IDs, in which some stores, such as
+// Firestore, don't allow "/".
+func rateLimitKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return hex.EncodeToString(ip.To16()[:8])
+}
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", f)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %v", f, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientIP returns the IP address of the client making r, or nil if it
+// can't be determined. Like requestlog, it starts from the address of the
+// peer; if that is a trusted proxy, the X-Forwarded-For header is followed
+// back, from the nearest hop, to the first address that isn't one. Addresses
+// further back can be forged by the client, so they are ignored.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && isTrusted(ip, trusted); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// isTrusted reports whether ip is in one of the trusted ranges.
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setRetryAfter sets the Retry-After header of a response to wait, rounded
+// up to whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
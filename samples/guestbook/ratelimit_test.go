@@ -0,0 +1,196 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateBucket(t *testing.T) {
+	l := &rateLimits{PerMinute: 6, Burst: 2} // a token every 10s
+	start := time.Unix(1700000000, 0)
+	b := new(rateBucket)
+	for _, step := range []struct {
+		at   time.Duration
+		want time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, 10 * time.Second},
+		{4 * time.Second, 6 * time.Second},
+		{10 * time.Second, 0},
+		{11 * time.Second, 9 * time.Second},
+		// A long wait only refills up to the burst.
+		{time.Hour, 0},
+		{time.Hour, 0},
+		{time.Hour, 10 * time.Second},
+		// A clock behind the bucket's doesn't refill it.
+		{time.Hour - time.Minute, 10 * time.Second},
+	} {
+		if got := b.take(l, start.Add(step.at)); got != step.want {
+			t.Errorf("take at %v: got wait %v, want %v", step.at, got, step.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"198.51.100.7:1234", nil, "198.51.100.7"},
+		{"[2001:db8::1]:1234", nil, "2001:db8::1"},
+		// Headers from untrusted peers are ignored.
+		{"198.51.100.7:1234", []string{"203.0.113.9"}, "198.51.100.7"},
+		{"192.0.2.1:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		// Only the hops added by trusted proxies are followed.
+		{"10.1.2.3:1234", []string{"6.6.6.6, 203.0.113.9, 10.0.0.5"}, "203.0.113.9"},
+		{"10.1.2.3:1234", []string{"6.6.6.6", "203.0.113.9"}, "203.0.113.9"},
+		{"10.1.2.3:1234", []string{"10.0.0.1, 10.0.0.5"}, "10.0.0.1"},
+		{"10.1.2.3:1234", []string{"garbage"}, "10.1.2.3"},
+		{"not an address", nil, "<nil>"},
+	} {
+		r := httptest.NewRequest("POST", "/sign", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, h := range test.xff {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if got := clientIP(r, trusted).String(); got != test.want {
+			t.Errorf("clientIP(%s, X-Forwarded-For %q) = %s, want %s", test.remoteAddr, test.xff, got, test.want)
+		}
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parseTrustedProxies accepted a bad CIDR range")
+	}
+	// IPv6 clients are limited by their /64, and their keys can be document
+	// IDs in any store.
+	for _, addr := range []string{"[2001:db8::1:2:3:4]:80", "[2001:db8::ffff:ffff:ffff:ffff]:80"} {
+		got := rateLimitKey(clientIP(&http.Request{RemoteAddr: addr}, nil))
+		if got != "20010db800000000" {
+			t.Errorf("rate limit key of IPv6 client %s = %q, want its /64 in hex", addr, got)
+		}
+		if strings.Contains(got, "/") {
+			t.Errorf("rate limit key of IPv6 client %s = %q, which contains a slash", addr, got)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	for _, test := range []struct {
+		name, storeURL string
+	}{
+		{"memory", ""},
+		{"docstore", "mem://ratelimits/Key"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			limiter, cleanup, err := openRateLimiter(ctx, &cliFlags{
+				rateLimitVarURL: "constant://?decoder=string&val=" + url.QueryEscape(`{"per_minute": 1, "burst": 2}`),
+				rateLimitURL:    test.storeURL,
+				trustedProxies:  "192.0.2.1",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			store, storeCleanup, err := memGreetingStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storeCleanup()
+			router := newRouter(newApplication(store, nil, nil, nil, nil, nil, nil, nil, nil, limiter, nil, nil, ""))
+			do := func(client, target, contentType, body string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("POST", target, strings.NewReader(body))
+				r.RemoteAddr = "192.0.2.1:1234"
+				r.Header.Set("X-Forwarded-For", client)
+				r.Header.Set("Content-Type", contentType)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				return w
+			}
+			sign := func(client string) *httptest.ResponseRecorder {
+				return do(client, "/sign", "application/x-www-form-urlencoded", "content=Hello")
+			}
+
+			for i := 0; i < 2; i++ {
+				if w := sign("203.0.113.9"); w.Code != http.StatusSeeOther {
+					t.Fatalf("sign %d: got status %d, want %d: %s", i, w.Code, http.StatusSeeOther, w.Body)
+				}
+			}
+			w := sign("203.0.113.9")
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("sign over the limit: got status %d, want %d", w.Code, http.StatusTooManyRequests)
+			}
+			if got := w.Header().Get("Retry-After"); got != "60" {
+				t.Errorf("sign over the limit: got Retry-After %q, want 60", got)
+			}
+			w = do("203.0.113.9", "/api/v1/greetings", "application/json", `{"content": "Hello"}`)
+			if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "ResourceExhausted") || w.Header().Get("Retry-After") == "" {
+				t.Errorf("API post over the limit: got status %d, Retry-After %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+			}
+			if w := sign("198.51.100.7"); w.Code != http.StatusSeeOther {
+				t.Errorf("sign from another client: got status %d, want %d", w.Code, http.StatusSeeOther)
+			}
+
+			// Liking is limited too, separately from signing.
+			like := func(client string) *httptest.ResponseRecorder {
+				return do(client, "/like", "application/x-www-form-urlencoded", "id=nosuchgreeting")
+			}
+			for i := 0; i < 2; i++ {
+				if w := like("198.51.100.8"); w.Code != http.StatusNotFound {
+					t.Fatalf("like %d: got status %d, want %d: %s", i, w.Code, http.StatusNotFound, w.Body)
+				}
+			}
+			if w := like("198.51.100.8"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+				t.Errorf("like over the limit: got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+			}
+			if w := sign("198.51.100.8"); w.Code != http.StatusSeeOther {
+				t.Errorf("sign after liking: got status %d, want %d", w.Code, http.StatusSeeOther)
+			}
+		})
+	}
+}
+
+func TestMemRateLimitStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	s, stop := newMemRateLimitStore()
+	defer stop()
+	l := &rateLimits{PerMinute: 6, Burst: 2} // a token every 10s
+	start := time.Unix(1700000000, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := s.take(ctx, key, l, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.take(ctx, "c", l, start.Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// Ten seconds on, a and b have refilled, but c is still a token short.
+	s.sweep(start.Add(10 * time.Second))
+	if len(s.buckets) != 1 || s.buckets["c"] == nil {
+		t.Errorf("after sweep: got buckets %v, want only c", s.buckets)
+	}
+}
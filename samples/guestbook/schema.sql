@@ -12,9 +12,33 @@
 -- See the License for the specific language governing permissions and
 -- limitations under the License.
 
+-- This is the schema at the latest migration in migrations/mysql, for
+-- provisioning a new database in one step. See migrate.go.
+
 CREATE TABLE greetings (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    book VARCHAR(64) NOT NULL DEFAULT '',
     content VARCHAR(255) CHARACTER SET utf8
         NOT NULL
         CHECK (content <> ''),
-    post_date DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+    post_date DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    attachment VARCHAR(255) CHARACTER SET utf8 NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL DEFAULT 'approved',
+    likes BIGINT NOT NULL DEFAULT 0,
+    INDEX greetings_by_book (book, status, post_date, id),
+    INDEX greetings_by_likes (book, status, likes, post_date, id)
+);
+
+CREATE TABLE schema_migrations (
+    version BIGINT NOT NULL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
+
+INSERT INTO schema_migrations (version, name) VALUES
+    (1, 'create_greetings'),
+    (2, 'add_ids'),
+    (3, 'add_attachments'),
+    (4, 'add_status'),
+    (5, 'add_books'),
+    (6, 'add_likes');
@@ -0,0 +1,86 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gocloud.dev/server"
+)
+
+// A drainCheck is a health check that fails once the server has started
+// shutting down, so that load balancers stop sending it new requests while
+// the requests it already has are finished.
+type drainCheck struct {
+	once     sync.Once
+	draining chan struct{}
+}
+
+func newDrainCheck() *drainCheck {
+	return &drainCheck{draining: make(chan struct{})}
+}
+
+// start marks the server as shutting down.
+func (d *drainCheck) start() {
+	d.once.Do(func() { close(d.draining) })
+}
+
+// done returns a channel that is closed when the server starts shutting
+// down. Long-lived requests should end when it is closed.
+func (d *drainCheck) done() <-chan struct{} {
+	return d.draining
+}
+
+// CheckHealth implements health.Checker.
+func (d *drainCheck) CheckHealth() error {
+	select {
+	case <-d.draining:
+		return errors.New("shutting down")
+	default:
+		return nil
+	}
+}
+
+// serve runs srv on addr until ctx is done, then shuts it down gracefully: it
+// fails the readiness check, waits for delay so that load balancers notice,
+// and then waits up to grace for in-flight requests to finish. serve returns
+// nil if the server shut down cleanly.
+func serve(ctx context.Context, srv *server.Server, addr string, drain *drainCheck, delay, grace time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(addr) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down; draining connections for up to %v", delay+grace)
+	drain.start()
+	time.Sleep(delay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,786 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gocloud.dev/docstore"
+	_ "gocloud.dev/docstore/awsdynamodb"
+	_ "gocloud.dev/docstore/gcpfirestore"
+	_ "gocloud.dev/docstore/memdocstore"
+	_ "gocloud.dev/docstore/mongodocstore"
+	"gocloud.dev/gcerrors"
+)
+
+// greetingsPerPage is the number of greetings shown on each page.
+const greetingsPerPage = 100
+
+// greeting is a single visitor message. When stored in a docstore collection,
+// ID is the key field, so the collection URL should name it (for example,
+// "mem://greetings/ID").
+type greeting struct {
+	ID         string
+	Book       string // name of the guestbook; empty for the main guestbook
+	Content    string
+	PostDate   time.Time
+	Attachment string // bucket key of an attached image; empty if none
+	Status     string // one of the status constants; empty means approved
+	Likes      int64  // number of visitors who liked the greeting
+
+	// DocstoreRevision is the revision of a greeting read from a docstore
+	// collection, which makes updates fail if the greeting has changed since.
+	DocstoreRevision interface{}
+}
+
+// Greeting statuses. Only approved greetings are shown to visitors.
+const (
+	statusApproved = "approved"
+	statusPending  = "pending"
+	statusRejected = "rejected"
+	statusHidden   = "hidden" // hidden by an administrator after approval
+)
+
+// visible reports whether g may be shown to visitors.
+func (g *greeting) visible() bool {
+	return g.Status == "" || g.Status == statusApproved
+}
+
+// cursor returns the position of g in the greetings.
+func (g *greeting) cursor() cursor {
+	return cursor{PostDate: g.PostDate, ID: g.ID}
+}
+
+// A cursor is a position in the greetings, which are ordered by post date and
+// then by ID to break ties between greetings posted at the same time.
+type cursor struct {
+	PostDate time.Time
+	ID       string
+}
+
+// less reports whether c comes before d.
+func (c cursor) less(d cursor) bool {
+	if !c.PostDate.Equal(d.PostDate) {
+		return c.PostDate.Before(d.PostDate)
+	}
+	return idLess(c.ID, d.ID)
+}
+
+// idLess orders greeting IDs. SQL IDs are integers and compare numerically;
+// other IDs compare as strings.
+func idLess(a, b string) bool {
+	if len(a) != len(b) && isDigits(a) && isDigits(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// String encodes c as an opaque token suitable for a URL query parameter.
+func (c cursor) String() string {
+	raw := strconv.FormatInt(c.PostDate.UnixNano(), 10) + "." + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// errBadCursor is returned for page cursors that were not produced by
+// cursor.String.
+var errBadCursor = errors.New("malformed cursor")
+
+// parseCursor decodes a token produced by cursor.String.
+func parseCursor(s string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, errBadCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ".")
+	if !ok {
+		return cursor{}, errBadCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return cursor{}, errBadCursor
+	}
+	return cursor{PostDate: time.Unix(0, n).UTC(), ID: id}, nil
+}
+
+// A page is a run of consecutive greetings, oldest first, together with the
+// cursors of the adjacent pages. Older and Newer are empty if there are no
+// older or newer greetings.
+type page struct {
+	Greetings []greeting
+	Older     string
+	Newer     string
+}
+
+// loadPage returns the page of up to limit greetings that come before the
+// cursor token before, or after the cursor token after. At most one of them
+// may be set. If neither is, or if the selected page would be empty, loadPage
+// returns the newest greetings. It returns errBadCursor if a token is
+// malformed.
+func loadPage(ctx context.Context, store greetingStore, before, after string, limit int) (*page, error) {
+	if before != "" && after != "" {
+		return nil, errBadCursor
+	}
+	var c *cursor
+	if tok := before + after; tok != "" {
+		pc, err := parseCursor(tok)
+		if err != nil {
+			return nil, err
+		}
+		c = &pc
+	}
+	// Fetch one extra greeting to learn whether there is another page in the
+	// direction of travel. In the other direction, there is always at least
+	// the greeting at the cursor.
+	p := new(page)
+	if after != "" {
+		greetings, err := store.after(ctx, *c, limit+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(greetings) > 0 {
+			if len(greetings) > limit {
+				greetings = greetings[:limit]
+				p.Newer = greetings[limit-1].cursor().String()
+			}
+			p.Greetings = greetings
+			p.Older = greetings[0].cursor().String()
+			return p, nil
+		}
+		c = nil
+	}
+	greetings, err := store.before(ctx, c, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(greetings) == 0 && c != nil {
+		return loadPage(ctx, store, "", "", limit)
+	}
+	if len(greetings) > limit {
+		greetings = greetings[1:]
+		p.Older = greetings[0].cursor().String()
+	}
+	if c != nil {
+		p.Newer = greetings[len(greetings)-1].cursor().String()
+	}
+	p.Greetings = greetings
+	return p, nil
+}
+
+// errGreetingNotFound is returned by greetingStore methods that look up a
+// greeting by ID when there is no such greeting.
+var errGreetingNotFound = errors.New("greeting not found")
+
+// greetingStore persists greetings. The application talks to its storage only
+// through this interface, so greetings can be kept in a SQL database or in
+// any gocloud.dev/docstore collection.
+//
+// Each store holds the greetings of a single guestbook; forBook returns a
+// store for another one. The before and after methods return only visible
+// greetings.
+type greetingStore interface {
+	// forBook returns a store for the greetings of the named guestbook. The
+	// main guestbook is named "".
+	forBook(book string) greetingStore
+	// before returns up to limit of the newest greetings that come before c,
+	// oldest first. If c is nil, it returns the newest greetings overall.
+	before(ctx context.Context, c *cursor, limit int) ([]greeting, error)
+	// after returns up to limit of the oldest greetings that come after c,
+	// oldest first.
+	after(ctx context.Context, c cursor, limit int) ([]greeting, error)
+	// add stores a new greeting, filling in its ID, its book and, if it is
+	// not set, its post date.
+	add(ctx context.Context, g *greeting) error
+	// pending returns up to limit of the oldest greetings awaiting
+	// moderation.
+	pending(ctx context.Context, limit int) ([]greeting, error)
+	// setStatus changes the status of the greeting with the given ID from
+	// from to to, and returns the changed greeting. It returns
+	// errGreetingNotFound if there is no such greeting with status from.
+	setStatus(ctx context.Context, id, from, to string) (*greeting, error)
+	// search returns up to limit of the newest greetings, whatever their
+	// status, whose content contains text, ignoring case. If text is empty,
+	// it returns the newest greetings.
+	search(ctx context.Context, text string, limit int) ([]greeting, error)
+	// delete deletes the greeting with the given ID and returns it. It
+	// returns errGreetingNotFound if there is no such greeting.
+	delete(ctx context.Context, id string) (*greeting, error)
+	// each calls fn for every greeting of every guestbook, in no particular
+	// order, stopping at the first error.
+	each(ctx context.Context, fn func(*greeting) error) error
+	// put stores g with its ID, replacing any greeting with the same ID.
+	put(ctx context.Context, g *greeting) error
+	// like adds one to the likes of the visible greeting with the given ID.
+	// It returns errGreetingNotFound if there is no such greeting.
+	like(ctx context.Context, id string) error
+	// mostLiked returns up to limit of the visible greetings with at least
+	// one like, most liked first. Greetings with as many likes are ordered
+	// newest first.
+	mostLiked(ctx context.Context, limit int) ([]greeting, error)
+}
+
+// openGreetingStore is a Wire provider function that returns the greeting
+// store selected by the command-line flags. If no greetings URL is given, the
+// greetings are kept in the SQL database.
+func openGreetingStore(ctx context.Context, db *sql.DB, flags *cliFlags) (greetingStore, func(), error) {
+	if flags.greetingsURL == "" {
+		dialect, err := flagsDialect(flags)
+		if err != nil {
+			return nil, nil, err
+		}
+		if flags.migrate != "" {
+			target, err := parseMigrationTarget(flags.migrate)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := migrateSchema(ctx, db, dialect, target); err != nil {
+				return nil, nil, err
+			}
+		}
+		return &sqlGreetingStore{db: db, dialect: dialect}, func() {}, nil
+	}
+	if flags.migrate != "" {
+		return nil, nil, errors.New("-migrate is only for greetings stored in SQL, not -greetings_url")
+	}
+	coll, err := docstore.OpenCollection(ctx, flags.greetingsURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &docstoreGreetingStore{coll: coll}, func() { coll.Close() }, nil
+}
+
+// sqlGreetingStore is a greetingStore backed by the greetings table in a MySQL
+// or Postgres database (see migrate.go). Queries are written with ?
+// placeholders and rebound for the dialect.
+type sqlGreetingStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	book    string
+}
+
+func (s *sqlGreetingStore) forBook(book string) greetingStore {
+	return &sqlGreetingStore{db: s.db, dialect: s.dialect, book: book}
+}
+
+func (s *sqlGreetingStore) before(ctx context.Context, c *cursor, limit int) ([]greeting, error) {
+	var greetings []greeting
+	var err error
+	if c == nil {
+		const query = "SELECT id, content, post_date, attachment, status, likes FROM greetings WHERE book = ? AND status = 'approved' ORDER BY post_date DESC, id DESC LIMIT ?;"
+		greetings, err = s.query(ctx, query, s.book, limit)
+	} else {
+		const query = "SELECT id, content, post_date, attachment, status, likes FROM greetings WHERE book = ? AND status = 'approved' AND (post_date < ? OR (post_date = ? AND id < ?)) ORDER BY post_date DESC, id DESC LIMIT ?;"
+		greetings, err = s.query(ctx, query, s.book, c.PostDate, c.PostDate, c.ID, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reverse(greetings)
+	return greetings, nil
+}
+
+func (s *sqlGreetingStore) after(ctx context.Context, c cursor, limit int) ([]greeting, error) {
+	const query = "SELECT id, content, post_date, attachment, status, likes FROM greetings WHERE book = ? AND status = 'approved' AND (post_date > ? OR (post_date = ? AND id > ?)) ORDER BY post_date ASC, id ASC LIMIT ?;"
+	return s.query(ctx, query, s.book, c.PostDate, c.PostDate, c.ID, limit)
+}
+
+// query runs a SELECT of the id, content, post_date, attachment, status and
+// likes columns of greetings in s's book.
+func (s *sqlGreetingStore) query(ctx context.Context, query string, args ...interface{}) ([]greeting, error) {
+	q, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	var greetings []greeting
+	for q.Next() {
+		g := greeting{Book: s.book}
+		if err := q.Scan(&g.ID, &g.Content, &g.PostDate, &g.Attachment, &g.Status, &g.Likes); err != nil {
+			return nil, err
+		}
+		greetings = append(greetings, g)
+	}
+	if err := q.Err(); err != nil {
+		return nil, err
+	}
+	return greetings, nil
+}
+
+func (s *sqlGreetingStore) add(ctx context.Context, g *greeting) error {
+	if g.PostDate.IsZero() {
+		// DATETIME columns have a resolution of one second.
+		g.PostDate = time.Now().UTC().Truncate(time.Second)
+	}
+	if g.Status == "" {
+		g.Status = statusApproved
+	}
+	g.Book = s.book
+	const sqlStmt = "INSERT INTO greetings (book, content, post_date, attachment, status) VALUES (?, ?, ?, ?, ?)"
+	args := []interface{}{g.Book, g.Content, g.PostDate, g.Attachment, g.Status}
+	var id int64
+	if s.dialect == dialectPostgres {
+		// The Postgres driver doesn't support LastInsertId.
+		if err := s.db.QueryRowContext(ctx, s.dialect.rebind(sqlStmt+" RETURNING id;"), args...).Scan(&id); err != nil {
+			return err
+		}
+	} else {
+		res, err := s.db.ExecContext(ctx, sqlStmt+";", args...)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	g.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+func (s *sqlGreetingStore) pending(ctx context.Context, limit int) ([]greeting, error) {
+	const query = "SELECT id, content, post_date, attachment, status, likes FROM greetings WHERE book = ? AND status = 'pending' ORDER BY post_date ASC, id ASC LIMIT ?;"
+	return s.query(ctx, query, s.book, limit)
+}
+
+func (s *sqlGreetingStore) setStatus(ctx context.Context, id, from, to string) (*greeting, error) {
+	if !isDigits(id) {
+		return nil, errGreetingNotFound
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	g := &greeting{ID: id, Book: s.book}
+	const query = "SELECT content, post_date, attachment, status, likes FROM greetings WHERE id = ? AND book = ? AND status = ? FOR UPDATE;"
+	err = tx.QueryRowContext(ctx, s.dialect.rebind(query), id, s.book, from).Scan(&g.Content, &g.PostDate, &g.Attachment, &g.Status, &g.Likes)
+	if err == sql.ErrNoRows {
+		return nil, errGreetingNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE greetings SET status = ? WHERE id = ?;"), to, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	g.Status = to
+	return g, nil
+}
+
+func (s *sqlGreetingStore) search(ctx context.Context, text string, limit int) ([]greeting, error) {
+	// Postgres compares case-sensitively, so lower both sides.
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(text)) + "%"
+	const query = "SELECT id, content, post_date, attachment, status, likes FROM greetings WHERE book = ? AND LOWER(content) LIKE ? ORDER BY post_date DESC, id DESC LIMIT ?;"
+	return s.query(ctx, query, s.book, pattern, limit)
+}
+
+func (s *sqlGreetingStore) like(ctx context.Context, id string) error {
+	if !isDigits(id) {
+		return errGreetingNotFound
+	}
+	const sqlStmt = "UPDATE greetings SET likes = likes + 1 WHERE id = ? AND book = ? AND status = 'approved';"
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(sqlStmt), id, s.book)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errGreetingNotFound
+	}
+	return nil
+}
+
+func (s *sqlGreetingStore) mostLiked(ctx context.Context, limit int) ([]greeting, error) {
+	const query = "SELECT id, content, post_date, attachment, status, likes FROM greetings WHERE book = ? AND status = 'approved' AND likes > 0 ORDER BY likes DESC, post_date DESC, id DESC LIMIT ?;"
+	return s.query(ctx, query, s.book, limit)
+}
+
+// likeEscaper escapes the characters that are special in LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *sqlGreetingStore) delete(ctx context.Context, id string) (*greeting, error) {
+	if !isDigits(id) {
+		return nil, errGreetingNotFound
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	g := &greeting{ID: id, Book: s.book}
+	const query = "SELECT content, post_date, attachment, status, likes FROM greetings WHERE id = ? AND book = ? FOR UPDATE;"
+	err = tx.QueryRowContext(ctx, s.dialect.rebind(query), id, s.book).Scan(&g.Content, &g.PostDate, &g.Attachment, &g.Status, &g.Likes)
+	if err == sql.ErrNoRows {
+		return nil, errGreetingNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("DELETE FROM greetings WHERE id = ?;"), id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (s *sqlGreetingStore) each(ctx context.Context, fn func(*greeting) error) error {
+	const query = "SELECT id, book, content, post_date, attachment, status, likes FROM greetings ORDER BY id;"
+	q, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	for q.Next() {
+		var g greeting
+		if err := q.Scan(&g.ID, &g.Book, &g.Content, &g.PostDate, &g.Attachment, &g.Status, &g.Likes); err != nil {
+			return err
+		}
+		if err := fn(&g); err != nil {
+			return err
+		}
+	}
+	return q.Err()
+}
+
+func (s *sqlGreetingStore) put(ctx context.Context, g *greeting) error {
+	id, err := strconv.ParseInt(g.ID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("greeting ID %q is not a SQL greeting ID", g.ID)
+	}
+	g.Book = s.book
+	args := []interface{}{id, g.Book, g.Content, g.PostDate, g.Attachment, g.Status, g.Likes}
+	if s.dialect == dialectPostgres {
+		const sqlStmt = "INSERT INTO greetings (id, book, content, post_date, attachment, status, likes) VALUES ($1, $2, $3, $4, $5, $6, $7) " +
+			"ON CONFLICT (id) DO UPDATE SET book = EXCLUDED.book, content = EXCLUDED.content, post_date = EXCLUDED.post_date, attachment = EXCLUDED.attachment, status = EXCLUDED.status, likes = EXCLUDED.likes;"
+		if _, err := s.db.ExecContext(ctx, sqlStmt, args...); err != nil {
+			return err
+		}
+		// Inserting IDs doesn't advance the sequence that generates them.
+		_, err := s.db.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('greetings', 'id'), (SELECT MAX(id) FROM greetings));")
+		return err
+	}
+	const sqlStmt = "INSERT INTO greetings (id, book, content, post_date, attachment, status, likes) VALUES (?, ?, ?, ?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE book = VALUES(book), content = VALUES(content), post_date = VALUES(post_date), attachment = VALUES(attachment), status = VALUES(status), likes = VALUES(likes);"
+	_, err = s.db.ExecContext(ctx, sqlStmt, args...)
+	return err
+}
+
+// docstoreGreetingStore is a greetingStore backed by a docstore collection.
+// Each greeting is a document keyed by a randomly generated ID. The greetings
+// of all guestbooks share the collection.
+type docstoreGreetingStore struct {
+	coll *docstore.Collection
+	book string
+}
+
+func (s *docstoreGreetingStore) forBook(book string) greetingStore {
+	return &docstoreGreetingStore{coll: s.coll, book: book}
+}
+
+// visibleQuery returns a query for the visible greetings in s's book.
+func (s *docstoreGreetingStore) visibleQuery() *docstore.Query {
+	return s.coll.Query().Where("Book", "=", s.book).Where("Status", "=", statusApproved)
+}
+
+func (s *docstoreGreetingStore) before(ctx context.Context, c *cursor, limit int) ([]greeting, error) {
+	q := s.visibleQuery()
+	if c != nil {
+		q = q.Where("PostDate", "<=", c.PostDate)
+	} else {
+		q = allPostDates(q)
+	}
+	greetings, err := s.query(ctx, q.OrderBy("PostDate", docstore.Descending), limit, true, func(g *greeting) bool {
+		return c == nil || g.cursor().less(*c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	reverse(greetings)
+	return greetings, nil
+}
+
+func (s *docstoreGreetingStore) after(ctx context.Context, c cursor, limit int) ([]greeting, error) {
+	q := s.visibleQuery().Where("PostDate", ">=", c.PostDate).OrderBy("PostDate", docstore.Ascending)
+	return s.query(ctx, q, limit, false, func(g *greeting) bool {
+		return c.less(g.cursor())
+	})
+}
+
+// allPostDates returns q restricted to greetings with any post date. Docstore
+// only allows a query with Where clauses to be ordered by a field that one of
+// them names.
+func allPostDates(q *docstore.Query) *docstore.Query {
+	return q.Where("PostDate", ">", time.Time{})
+}
+
+// query runs q, which must be ordered by PostDate, and returns up to limit of
+// the greetings for which keep returns true. Docstore can order by only one
+// field, so the ID tie-break is applied here: the query is read past limit
+// until the post date changes, and the results are then sorted by cursor,
+// newest first if desc is true. Greetings at the cursor, which the query
+// can't exclude for the same reason, are dropped by keep.
+//
+// The queries filter on Book and Status, so Firestore needs composite indexes
+// of those fields with PostDate and with Likes.
+func (s *docstoreGreetingStore) query(ctx context.Context, q *docstore.Query, limit int, desc bool, keep func(*greeting) bool) ([]greeting, error) {
+	iter := q.Get(ctx)
+	defer iter.Stop()
+	var greetings []greeting
+	for {
+		var g greeting
+		err := iter.Next(ctx, &g)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !keep(&g) {
+			continue
+		}
+		if len(greetings) >= limit && !g.PostDate.Equal(greetings[len(greetings)-1].PostDate) {
+			break
+		}
+		greetings = append(greetings, g)
+	}
+	sort.Slice(greetings, func(i, j int) bool {
+		if desc {
+			return greetings[j].cursor().less(greetings[i].cursor())
+		}
+		return greetings[i].cursor().less(greetings[j].cursor())
+	})
+	if len(greetings) > limit {
+		greetings = greetings[:limit]
+	}
+	return greetings, nil
+}
+
+func (s *docstoreGreetingStore) add(ctx context.Context, g *greeting) error {
+	if g.ID == "" {
+		g.ID = uuid.NewString()
+	}
+	if g.PostDate.IsZero() {
+		g.PostDate = time.Now().UTC()
+	}
+	if g.Status == "" {
+		g.Status = statusApproved
+	}
+	g.Book = s.book
+	return s.coll.Create(ctx, g)
+}
+
+func (s *docstoreGreetingStore) pending(ctx context.Context, limit int) ([]greeting, error) {
+	// The moderation queue is expected to be short, so read all of it rather
+	// than requiring another index that includes PostDate.
+	iter := s.coll.Query().Where("Book", "=", s.book).Where("Status", "=", statusPending).Get(ctx)
+	defer iter.Stop()
+	var greetings []greeting
+	for {
+		var g greeting
+		err := iter.Next(ctx, &g)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		greetings = append(greetings, g)
+	}
+	sort.Slice(greetings, func(i, j int) bool {
+		return greetings[i].cursor().less(greetings[j].cursor())
+	})
+	if len(greetings) > limit {
+		greetings = greetings[:limit]
+	}
+	return greetings, nil
+}
+
+// setStatusAttempts is the number of times docstoreGreetingStore.setStatus
+// tries to update a greeting that is also being updated by other requests.
+const setStatusAttempts = 5
+
+func (s *docstoreGreetingStore) setStatus(ctx context.Context, id, from, to string) (*greeting, error) {
+	for i := 0; ; i++ {
+		g, err := s.get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if g.Status != from {
+			return nil, errGreetingNotFound
+		}
+		// The update fails if the greeting has changed since it was read,
+		// so two moderators can't both change its status. If it was only
+		// liked in the meantime, try again.
+		err = s.coll.Update(ctx, g, docstore.Mods{"Status": to})
+		switch gcerrors.Code(err) {
+		case gcerrors.OK:
+			g.Status = to
+			return g, nil
+		case gcerrors.NotFound:
+			return nil, errGreetingNotFound
+		case gcerrors.FailedPrecondition:
+			if i+1 < setStatusAttempts {
+				continue
+			}
+		}
+		return nil, err
+	}
+}
+
+func (s *docstoreGreetingStore) search(ctx context.Context, text string, limit int) ([]greeting, error) {
+	text = strings.ToLower(text)
+	q := allPostDates(s.coll.Query().Where("Book", "=", s.book)).OrderBy("PostDate", docstore.Descending)
+	return s.query(ctx, q, limit, true, func(g *greeting) bool {
+		return strings.Contains(strings.ToLower(g.Content), text)
+	})
+}
+
+func (s *docstoreGreetingStore) delete(ctx context.Context, id string) (*greeting, error) {
+	g, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	g.DocstoreRevision = nil // delete it even if it was liked since
+	if err := s.coll.Delete(ctx, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (s *docstoreGreetingStore) like(ctx context.Context, id string) error {
+	g, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !g.visible() {
+		return errGreetingNotFound
+	}
+	// Increment is applied atomically by the provider, so concurrent likes
+	// are all counted without checking the revision.
+	g.DocstoreRevision = nil
+	err = s.coll.Update(ctx, g, docstore.Mods{"Likes": docstore.Increment(1)})
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return errGreetingNotFound
+	}
+	return err
+}
+
+func (s *docstoreGreetingStore) mostLiked(ctx context.Context, limit int) ([]greeting, error) {
+	// As in query, read past limit until the number of likes changes, so
+	// that ties are broken the same way as in SQL.
+	iter := s.visibleQuery().Where("Likes", ">", 0).OrderBy("Likes", docstore.Descending).Get(ctx)
+	defer iter.Stop()
+	var greetings []greeting
+	for {
+		var g greeting
+		err := iter.Next(ctx, &g)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(greetings) >= limit && g.Likes != greetings[len(greetings)-1].Likes {
+			break
+		}
+		greetings = append(greetings, g)
+	}
+	sort.Slice(greetings, func(i, j int) bool {
+		if greetings[i].Likes != greetings[j].Likes {
+			return greetings[i].Likes > greetings[j].Likes
+		}
+		return greetings[j].cursor().less(greetings[i].cursor())
+	})
+	if len(greetings) > limit {
+		greetings = greetings[:limit]
+	}
+	return greetings, nil
+}
+
+func (s *docstoreGreetingStore) each(ctx context.Context, fn func(*greeting) error) error {
+	iter := s.coll.Query().Get(ctx)
+	defer iter.Stop()
+	for {
+		var g greeting
+		err := iter.Next(ctx, &g)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(&g); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *docstoreGreetingStore) put(ctx context.Context, g *greeting) error {
+	g.Book = s.book
+	if g.Status == "" {
+		// The queries for visible greetings match on Status.
+		g.Status = statusApproved
+	}
+	g.DocstoreRevision = nil
+	return s.coll.Put(ctx, g)
+}
+
+// get returns the greeting in s's book with the given ID, or
+// errGreetingNotFound.
+func (s *docstoreGreetingStore) get(ctx context.Context, id string) (*greeting, error) {
+	g := &greeting{ID: id}
+	if err := s.coll.Get(ctx, g); err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, errGreetingNotFound
+		}
+		return nil, err
+	}
+	if g.Book != s.book {
+		return nil, errGreetingNotFound
+	}
+	return g, nil
+}
+
+// reverse reverses greetings in place.
+func reverse(greetings []greeting) {
+	for i, j := 0, len(greetings)-1; i < j; i, j = i+1, j-1 {
+		greetings[i], greetings[j] = greetings[j], greetings[i]
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore/memdocstore"
+)
+
+func TestDocstoreGreetingStore(t *testing.T) {
+	ctx := context.Background()
+	store, cleanup, err := openGreetingStore(ctx, nil, &cliFlags{greetingsURL: "mem://greetings-DocstoreGreetingStore/ID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	p, err := loadPage(ctx, store, "", "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Greetings) != 0 || p.Older != "" || p.Newer != "" {
+		t.Fatalf("got %+v for a new store, want an empty page", p)
+	}
+
+	// Add greetings g0 through g7. Pairs of them share a post date, so paging
+	// has to break ties by ID.
+	start := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		g := &greeting{
+			ID:       fmt.Sprintf("g%d", i),
+			Content:  fmt.Sprintf("greeting %d", i),
+			PostDate: start.Add(time.Duration(i/2) * time.Minute),
+		}
+		if err := store.add(ctx, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := &greeting{Content: "no ID", PostDate: start.Add(-time.Hour)}
+	if err := store.add(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+	if g.ID == "" {
+		t.Fatal("add did not assign an ID")
+	}
+
+	ids := func(p *page) []string {
+		var ids []string
+		for _, g := range p.Greetings {
+			ids = append(ids, g.ID)
+		}
+		return ids
+	}
+
+	// Walk from the newest page to the oldest and back.
+	var olderPages [][]string
+	p, err = loadPage(ctx, store, "", "", 3)
+	for {
+		if err != nil {
+			t.Fatal(err)
+		}
+		olderPages = append(olderPages, ids(p))
+		if p.Older == "" {
+			break
+		}
+		p, err = loadPage(ctx, store, p.Older, "", 3)
+	}
+	wantOlder := [][]string{{"g5", "g6", "g7"}, {"g2", "g3", "g4"}, {g.ID, "g0", "g1"}}
+	if diff := cmp.Diff(wantOlder, olderPages); diff != "" {
+		t.Errorf("paging to older greetings (-want +got):\n%s", diff)
+	}
+	var newerPages [][]string
+	for {
+		if p.Newer == "" {
+			break
+		}
+		p, err = loadPage(ctx, store, "", p.Newer, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newerPages = append(newerPages, ids(p))
+	}
+	wantNewer := [][]string{{"g2", "g3", "g4"}, {"g5", "g6", "g7"}}
+	if diff := cmp.Diff(wantNewer, newerPages); diff != "" {
+		t.Errorf("paging to newer greetings (-want +got):\n%s", diff)
+	}
+
+	if _, err := loadPage(ctx, store, "not a cursor", "", 3); err != errBadCursor {
+		t.Errorf("got error %v for a malformed cursor, want %v", err, errBadCursor)
+	}
+}
+
+func TestDocstoreSetStatus(t *testing.T) {
+	ctx := context.Background()
+	store, cleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	other := store.forBook("other")
+	g := &greeting{Content: "hello", Status: statusPending}
+	if err := other.add(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.setStatus(ctx, g.ID, statusPending, statusApproved); err != errGreetingNotFound {
+		t.Errorf("setStatus in another book: got %v, want %v", err, errGreetingNotFound)
+	}
+
+	// Moderators approve and reject the greeting at once while it is being
+	// liked. Exactly one of them must succeed.
+	const n = 10
+	errs := make(chan error, 2*n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		to := statusApproved
+		if i%2 == 1 {
+			to = statusRejected
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := other.setStatus(ctx, g.ID, statusPending, to)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			other.like(ctx, g.ID) // fails unless the greeting is approved
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			succeeded++
+		case errGreetingNotFound:
+		default:
+			t.Errorf("setStatus: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d status changes succeeded, want 1", succeeded)
+	}
+}
+
+func TestSQLGreetingStoreBadID(t *testing.T) {
+	// IDs in SQL are integers; other IDs name no greeting, and never reach
+	// the database, where Postgres would fail to cast them.
+	ctx := context.Background()
+	store := &sqlGreetingStore{dialect: dialectPostgres}
+	for _, id := range []string{"", "abc", "1; DROP TABLE greetings", "-1"} {
+		if _, err := store.setStatus(ctx, id, statusPending, statusApproved); err != errGreetingNotFound {
+			t.Errorf("setStatus(%q): got %v, want %v", id, err, errGreetingNotFound)
+		}
+		if err := store.like(ctx, id); err != errGreetingNotFound {
+			t.Errorf("like(%q): got %v, want %v", id, err, errGreetingNotFound)
+		}
+		if _, err := store.delete(ctx, id); err != errGreetingNotFound {
+			t.Errorf("delete(%q): got %v, want %v", id, err, errGreetingNotFound)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	c := cursor{PostDate: time.Date(2019, 7, 1, 12, 30, 0, 123, time.UTC), ID: "42.b"}
+	got, err := parseCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, c) {
+		t.Errorf("got %+v, want %+v", got, c)
+	}
+
+	for _, test := range []struct {
+		a, b string
+		want bool
+	}{
+		{"9", "10", true},
+		{"10", "9", false},
+		{"10", "11", true},
+		{"a", "b", true},
+		{"b", "a", false},
+		{"a", "a", false},
+	} {
+		if got := idLess(test.a, test.b); got != test.want {
+			t.Errorf("idLess(%q, %q) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// memGreetingStore returns a greeting store backed by a new in-memory docstore
+// collection.
+func memGreetingStore() (greetingStore, func(), error) {
+	coll, err := memdocstore.OpenCollection("ID", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &docstoreGreetingStore{coll: coll}, func() { coll.Close() }, nil
+}
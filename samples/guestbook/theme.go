@@ -0,0 +1,196 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// A theme is the template of the index page and the static assets it uses,
+// such as style sheets. The built-in theme is in the theme directory: the
+// template is theme/index.html, and the files in theme/static are served
+// under /static/.
+//
+// With -theme_url, the template and assets are read from a bucket with the
+// same layout, so that the page can be restyled without a new release. The
+// template is parsed again when its blob changes, and any of its files that
+// are missing from the bucket are served from the built-in theme instead.
+
+//go:embed theme
+var themeFiles embed.FS
+
+// builtinIndexTmpl is the built-in template of the index page.
+var builtinIndexTmpl = template.Must(template.ParseFS(themeFiles, "theme/index.html"))
+
+const (
+	// themeIndexKey is the key of the index template in a theme bucket.
+	themeIndexKey = "index.html"
+	// themeStaticPrefix is the prefix of the static assets in a theme bucket.
+	themeStaticPrefix = "static/"
+	// themeCheckInterval is how often a theme bucket is checked for a new
+	// index template.
+	themeCheckInterval = 5 * time.Second
+)
+
+// A theme serves the index template and static assets from a bucket. A nil
+// *theme serves the built-in theme.
+type theme struct {
+	bucket *blob.Bucket
+
+	mu         sync.Mutex
+	checked    time.Time          // when the template was last checked
+	refreshing bool               // whether a request is checking the template
+	version    string             // ETag or modification time of the template
+	index      *template.Template // nil if the bucket has no usable template
+}
+
+// openTheme is a Wire provider function that opens the bucket named by
+// -theme_url. It returns nil if the flag is empty.
+func openTheme(ctx context.Context, flags *cliFlags) (*theme, func(), error) {
+	if flags.themeURL == "" {
+		return nil, func() {}, nil
+	}
+	b, err := blob.OpenBucket(ctx, flags.themeURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening -theme_url: %v", err)
+	}
+	return &theme{bucket: b}, func() { b.Close() }, nil
+}
+
+// indexTemplate returns the template of the index page. If the theme's
+// template can't be read or parsed, it returns the built-in one.
+//
+// When the template is due to be checked, the first request to notice checks
+// it without holding th.mu; other requests meanwhile use the last template,
+// so that a slow bucket holds up only that one request.
+func (th *theme) indexTemplate(ctx context.Context) *template.Template {
+	if th == nil {
+		return builtinIndexTmpl
+	}
+	th.mu.Lock()
+	if !th.refreshing && time.Since(th.checked) >= themeCheckInterval {
+		th.refreshing = true
+		version := th.version
+		th.mu.Unlock()
+		newVersion, index, changed := th.load(ctx, version)
+		th.mu.Lock()
+		th.refreshing = false
+		th.checked = time.Now()
+		if changed {
+			th.version, th.index = newVersion, index
+		}
+	}
+	index := th.index
+	th.mu.Unlock()
+	if index == nil {
+		return builtinIndexTmpl
+	}
+	return index
+}
+
+// load parses the theme's template again if it has changed from version,
+// the version last parsed. It reports whether the template changed, with the
+// new version and template; the template is nil if the bucket has no usable
+// one.
+func (th *theme) load(ctx context.Context, version string) (newVersion string, index *template.Template, changed bool) {
+	attrs, err := th.bucket.Attributes(ctx, themeIndexKey)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return "", nil, true
+	}
+	if err != nil {
+		// Keep the last template until the bucket can be read again.
+		log.Println("theme error:", err)
+		return "", nil, false
+	}
+	newVersion = attrs.ETag
+	if newVersion == "" {
+		newVersion = strconv.FormatInt(attrs.ModTime.UnixNano(), 10) + "/" + strconv.FormatInt(attrs.Size, 10)
+	}
+	if newVersion == version {
+		return "", nil, false
+	}
+	data, err := th.bucket.ReadAll(ctx, themeIndexKey)
+	if err != nil {
+		log.Println("theme error:", err)
+		return "", nil, false
+	}
+	// Report the new version even if it doesn't parse, so that a broken
+	// template is reported once rather than on every check.
+	t, err := template.New(themeIndexKey).Parse(string(data))
+	if err != nil {
+		log.Printf("theme error: using the built-in template: %v", err)
+		return newVersion, nil, true
+	}
+	return newVersion, t, true
+}
+
+// renderIndex executes the index template with data. If the theme's template
+// fails, it falls back to the built-in one.
+func (th *theme) renderIndex(ctx context.Context, data interface{}) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	t := th.indexTemplate(ctx)
+	err := t.Execute(buf, data)
+	if err == nil || t == builtinIndexTmpl {
+		return buf, err
+	}
+	log.Printf("theme error: using the built-in template: %v", err)
+	buf.Reset()
+	return buf, builtinIndexTmpl.Execute(buf, data)
+}
+
+// staticFiles serves the built-in static assets.
+var staticFiles = func() http.Handler {
+	sub, err := fs.Sub(themeFiles, "theme/static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}()
+
+// serveStatic handles a request for a static asset of the theme.
+func (app *application) serveStatic(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if app.theme != nil {
+		err := serveBucketBlob(w, r, app.theme.bucket, themeStaticPrefix+key)
+		if err == nil {
+			return
+		}
+		if gcerrors.Code(err) != gcerrors.NotFound {
+			log.Println("serve static:", err)
+			http.Error(w, "blob read error", http.StatusInternalServerError)
+			return
+		}
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + key
+	r2.URL.RawPath = ""
+	// The built-in assets change only with a new release.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	staticFiles.ServeHTTP(w, r2)
+}
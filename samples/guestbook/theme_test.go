@@ -0,0 +1,116 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+func TestTheme(t *testing.T) {
+	ctx := context.Background()
+	store, storeCleanup, err := memGreetingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storeCleanup()
+	motd := constantvar.New("")
+	defer motd.Close()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	th := &theme{bucket: bucket}
+	router := newRouter(newApplication(store, nil, motd, nil, nil, nil, nil, nil, nil, nil, nil, th, ""))
+	get := func(target string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d", target, w.Code)
+		}
+		return w.Body.String()
+	}
+	// setIndex replaces the theme's template, and makes the next request
+	// check for it.
+	setIndex := func(text string) {
+		t.Helper()
+		if err := bucket.WriteAll(ctx, themeIndexKey, []byte(text), nil); err != nil {
+			t.Fatal(err)
+		}
+		th.mu.Lock()
+		th.checked = time.Time{}
+		th.mu.Unlock()
+	}
+	const builtin = `<form action="/sign"`
+
+	for _, step := range []struct {
+		name  string
+		index string // "" to leave the template unchanged
+		want  string
+	}{
+		{"no template", "", builtin},
+		{"template", `<p class="custom">{{.Title}}</p>`, `<p class="custom">Guestbook</p>`},
+		{"parse error", `<p>{{.Title</p>`, builtin},
+		{"fixed", `<p class="fixed">{{.Title}}</p>`, `<p class="fixed">`},
+		{"execution error", `<p>{{.Title.Nope}}</p>`, builtin},
+	} {
+		if step.index != "" {
+			setIndex(step.index)
+		}
+		if body := get("/"); !strings.Contains(body, step.want) {
+			t.Errorf("%s: index page doesn't contain %q:\n%s", step.name, step.want, body)
+		}
+	}
+
+	// While one request is checking the template, others use the last one
+	// rather than waiting for the bucket.
+	setIndex(`<p class="fixed">{{.Title}}</p>`)
+	get("/")
+	setIndex(`<p class="newer">{{.Title}}</p>`)
+	th.mu.Lock()
+	th.refreshing = true
+	th.mu.Unlock()
+	if body := get("/"); !strings.Contains(body, `<p class="fixed">`) {
+		t.Errorf("during a check: index page doesn't use the last template:\n%s", body)
+	}
+	th.mu.Lock()
+	th.refreshing = false
+	th.mu.Unlock()
+	if body := get("/"); !strings.Contains(body, `<p class="newer">`) {
+		t.Errorf("after a check: index page doesn't use the new template:\n%s", body)
+	}
+
+	// Static assets missing from the theme come from the built-in theme.
+	if body := get("/static/style.css"); !strings.Contains(body, ".greeting {") {
+		t.Errorf("built-in style sheet: got %q", body)
+	}
+	if err := bucket.WriteAll(ctx, themeStaticPrefix+"style.css", []byte("body { color: teal; }"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if body := get("/static/style.css"); body != "body { color: teal; }" {
+		t.Errorf("theme style sheet: got %q", body)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/static/missing.css", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /static/missing.css: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -8,209 +8,202 @@ package main
 
 import (
 	"context"
-	"contrib.go.opencensus.io/exporter/stackdriver/monitoredresource"
-	"database/sql"
-	"fmt"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
-	"github.com/aws/aws-sdk-go/aws/client"
-	"github.com/go-sql-driver/mysql"
 	"go.opencensus.io/trace"
-	"gocloud.dev/aws"
-	"gocloud.dev/aws/rds"
-	"gocloud.dev/blob"
-	"gocloud.dev/blob/azureblob"
-	"gocloud.dev/blob/fileblob"
-	"gocloud.dev/blob/gcsblob"
-	"gocloud.dev/blob/s3blob"
-	"gocloud.dev/gcp"
-	"gocloud.dev/gcp/cloudsql"
-	"gocloud.dev/mysql/awsmysql"
-	"gocloud.dev/mysql/gcpmysql"
-	"gocloud.dev/runtimevar"
-	"gocloud.dev/runtimevar/awsparamstore"
-	"gocloud.dev/runtimevar/blobvar"
-	"gocloud.dev/runtimevar/filevar"
-	"gocloud.dev/runtimevar/gcpruntimeconfig"
 	"gocloud.dev/server"
-	"gocloud.dev/server/requestlog"
-	"gocloud.dev/server/sdserver"
-	"gocloud.dev/server/xrayserver"
-	"google.golang.org/genproto/googleapis/cloud/runtimeconfig/v1beta1"
-	"net/http"
-	"net/url"
 )
 
-// Injectors from inject_aws.go:
+import (
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/memblob"
+	_ "gocloud.dev/blob/s3blob"
+	_ "gocloud.dev/docstore/awsdynamodb"
+	_ "gocloud.dev/docstore/gcpfirestore"
+	_ "gocloud.dev/docstore/memdocstore"
+	_ "gocloud.dev/docstore/mongodocstore"
+	_ "gocloud.dev/mysql/awsmysql"
+	_ "gocloud.dev/mysql/azuremysql"
+	_ "gocloud.dev/mysql/gcpmysql"
+	_ "gocloud.dev/postgres/awspostgres"
+	_ "gocloud.dev/postgres/gcppostgres"
+	_ "gocloud.dev/pubsub/awssnssqs"
+	_ "gocloud.dev/pubsub/azuresb"
+	_ "gocloud.dev/pubsub/gcppubsub"
+	_ "gocloud.dev/pubsub/mempubsub"
+	_ "gocloud.dev/runtimevar/awsparamstore"
+	_ "gocloud.dev/runtimevar/constantvar"
+	_ "gocloud.dev/runtimevar/filevar"
+	_ "gocloud.dev/runtimevar/gcpruntimeconfig"
+	_ "gocloud.dev/runtimevar/httpvar"
+	_ "gocloud.dev/secrets/awskms"
+	_ "gocloud.dev/secrets/azurekeyvault"
+	_ "gocloud.dev/secrets/gcpkms"
+	_ "gocloud.dev/secrets/localsecrets"
+)
 
-// setupAWS is a Wire injector function that sets up the application using AWS.
-func setupAWS(ctx context.Context, flags *cliFlags) (*server.Server, func(), error) {
-	client := _wireClientValue
-	certFetcher := &rds.CertFetcher{
-		Client: client,
-	}
-	urlOpener := &awsmysql.URLOpener{
-		CertSource: certFetcher,
-	}
-	db, cleanup, err := openAWSDatabase(ctx, urlOpener, flags)
+// Injectors from inject.go:
+
+// setup is a Wire injector function that sets up the application on the
+// resources named by the command-line flags.
+func setup(ctx context.Context, flags *cliFlags, drain *drainCheck) (*guestbook, func(), error) {
+	db, cleanup, err := openSQLDatabase(ctx, flags)
 	if err != nil {
 		return nil, nil, err
 	}
-	session, err := aws.NewDefaultSession()
+	mainGreetingStore, cleanup2, err := openGreetingStore(ctx, db, flags)
 	if err != nil {
 		cleanup()
 		return nil, nil, err
 	}
-	bucket, cleanup2, err := awsBucket(ctx, session, flags)
+	bucket, cleanup3, err := openBucket(ctx, flags)
 	if err != nil {
+		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	variable, err := awsMOTDVar(ctx, session, flags)
+	variable, cleanup4, err := openMOTDVar(ctx, flags, bucket)
 	if err != nil {
+		cleanup3()
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	mainApplication := newApplication(db, bucket, variable)
-	router := newRouter(mainApplication)
-	ncsaLogger := xrayserver.NewRequestLogger()
-	v, cleanup3 := appHealthChecks(db)
-	xRay := xrayserver.NewXRayClient(session)
-	exporter, cleanup4, err := xrayserver.NewExporter(xRay)
+	mainModerationQueue, cleanup5, err := openModerationQueue(ctx, flags)
 	if err != nil {
+		cleanup4()
 		cleanup3()
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	sampler := trace.AlwaysSample()
-	defaultDriver := _wireDefaultDriverValue
-	options := &server.Options{
-		RequestLogger:         ncsaLogger,
-		HealthChecks:          v,
-		TraceExporter:         exporter,
-		DefaultSamplingPolicy: sampler,
-		Driver:                defaultDriver,
-	}
-	serverServer := server.New(router, options)
-	return serverServer, func() {
+	mainContentFilter, cleanup6, err := openContentFilter(ctx, flags)
+	if err != nil {
+		cleanup5()
 		cleanup4()
 		cleanup3()
 		cleanup2()
 		cleanup()
-	}, nil
-}
-
-var (
-	_wireClientValue        = http.DefaultClient
-	_wireDefaultDriverValue = &server.DefaultDriver{}
-)
-
-// Injectors from inject_azure.go:
-
-// setupAzure is a Wire injector function that sets up the application using
-// Azure.
-func setupAzure(ctx context.Context, flags *cliFlags) (*server.Server, func(), error) {
-	db, err := dialLocalSQL(flags)
-	if err != nil {
-		return nil, nil, err
-	}
-	serviceURLOptions := azureblob.NewDefaultServiceURLOptions()
-	serviceURL, err := azureblob.NewServiceURL(serviceURLOptions)
-	if err != nil {
-		return nil, nil, err
-	}
-	containerName := bucketName(flags)
-	client, err := azureblob.NewDefaultClient(serviceURL, containerName)
-	if err != nil {
-		return nil, nil, err
-	}
-	bucket, cleanup, err := azureBucket(ctx, client, flags)
-	if err != nil {
 		return nil, nil, err
 	}
-	variable, err := azureMOTDVar(ctx, bucket, flags)
+	mainEventHub, cleanup7, err := openEventHub(ctx, flags, drain)
 	if err != nil {
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	mainApplication := newApplication(db, bucket, variable)
-	router := newRouter(mainApplication)
-	logger := _wireLoggerValue
-	v, cleanup2 := appHealthChecks(db)
-	exporter := _wireExporterValue
-	sampler := trace.AlwaysSample()
-	defaultDriver := _wireDefaultDriverValue
-	options := &server.Options{
-		RequestLogger:         logger,
-		HealthChecks:          v,
-		TraceExporter:         exporter,
-		DefaultSamplingPolicy: sampler,
-		Driver:                defaultDriver,
-	}
-	serverServer := server.New(router, options)
-	return serverServer, func() {
+	mainBookBucketOpener, err := openBookBuckets(flags)
+	if err != nil {
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
 		cleanup2()
 		cleanup()
-	}, nil
-}
-
-var (
-	_wireLoggerValue   = requestlog.Logger(nil)
-	_wireExporterValue = trace.Exporter(nil)
-)
-
-// Injectors from inject_gcp.go:
-
-// setupGCP is a Wire injector function that sets up the application using GCP.
-func setupGCP(ctx context.Context, flags *cliFlags) (*server.Server, func(), error) {
-	roundTripper := gcp.DefaultTransport()
-	credentials, err := gcp.DefaultCredentials(ctx)
-	if err != nil {
 		return nil, nil, err
 	}
-	tokenSource := gcp.CredentialsTokenSource(credentials)
-	httpClient, err := gcp.NewHTTPClient(roundTripper, tokenSource)
+	mainBookRegistry, cleanup8, err := openBookRegistry(ctx, flags, mainBookBucketOpener)
 	if err != nil {
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
 		return nil, nil, err
 	}
-	remoteCertSource := cloudsql.NewCertSource(httpClient)
-	urlOpener := &gcpmysql.URLOpener{
-		CertSource: remoteCertSource,
-	}
-	projectID, err := gcp.DefaultProjectID(credentials)
+	mainAdminAuth, cleanup9, err := openAdminAuth(ctx, flags)
 	if err != nil {
+		cleanup8()
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
 		return nil, nil, err
 	}
-	db, cleanup, err := openGCPDatabase(ctx, urlOpener, projectID, flags)
+	mainAuditLog, cleanup10, err := openAuditLog(ctx, flags)
 	if err != nil {
+		cleanup9()
+		cleanup8()
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
 		return nil, nil, err
 	}
-	bucket, cleanup2, err := gcpBucket(ctx, flags, httpClient)
+	mainRateLimiter, cleanup11, err := openRateLimiter(ctx, flags)
 	if err != nil {
+		cleanup10()
+		cleanup9()
+		cleanup8()
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	runtimeConfigManagerClient, cleanup3, err := gcpruntimeconfig.Dial(ctx, tokenSource)
+	mainLikeTracker, cleanup12, err := openLikeTracker(ctx, flags)
 	if err != nil {
+		cleanup11()
+		cleanup10()
+		cleanup9()
+		cleanup8()
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	variable, cleanup4, err := gcpMOTDVar(ctx, runtimeConfigManagerClient, projectID, flags)
+	mainTheme, cleanup13, err := openTheme(ctx, flags)
 	if err != nil {
+		cleanup12()
+		cleanup11()
+		cleanup10()
+		cleanup9()
+		cleanup8()
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
 		cleanup3()
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	mainApplication := newApplication(db, bucket, variable)
+	mainSiteURL := flagsSiteURL(flags)
+	mainApplication := newApplication(mainGreetingStore, bucket, variable, mainModerationQueue, mainContentFilter, mainEventHub, mainBookRegistry, mainAdminAuth, mainAuditLog, mainRateLimiter, mainLikeTracker, mainTheme, mainSiteURL)
 	router := newRouter(mainApplication)
-	stackdriverLogger := sdserver.NewRequestLogger()
-	v, cleanup5 := appHealthChecks(db)
-	monitoredresourceInterface := monitoredresource.Autodetect()
-	exporter, cleanup6, err := sdserver.NewExporter(projectID, tokenSource, monitoredresourceInterface)
+	logger := requestLogger(flags)
+	v, cleanup14 := appHealthChecks(mainGreetingStore, bucket, variable, drain)
+	exporter, cleanup15, err := traceExporter(ctx, flags)
 	if err != nil {
+		cleanup14()
+		cleanup13()
+		cleanup12()
+		cleanup11()
+		cleanup10()
+		cleanup9()
+		cleanup8()
+		cleanup7()
+		cleanup6()
 		cleanup5()
 		cleanup4()
 		cleanup3()
@@ -221,195 +214,53 @@ func setupGCP(ctx context.Context, flags *cliFlags) (*server.Server, func(), err
 	sampler := trace.AlwaysSample()
 	defaultDriver := _wireDefaultDriverValue
 	options := &server.Options{
-		RequestLogger:         stackdriverLogger,
+		RequestLogger:         logger,
 		HealthChecks:          v,
 		TraceExporter:         exporter,
 		DefaultSamplingPolicy: sampler,
 		Driver:                defaultDriver,
 	}
 	serverServer := server.New(router, options)
-	return serverServer, func() {
+	mainBackups, cleanup16, err := openBackups(ctx, flags, mainGreetingStore)
+	if err != nil {
+		cleanup15()
+		cleanup14()
+		cleanup13()
+		cleanup12()
+		cleanup11()
+		cleanup10()
+		cleanup9()
+		cleanup8()
+		cleanup7()
 		cleanup6()
 		cleanup5()
 		cleanup4()
 		cleanup3()
 		cleanup2()
 		cleanup()
-	}, nil
-}
-
-// Injectors from inject_local.go:
-
-// setupLocal is a Wire injector function that sets up the application using
-// local implementations.
-func setupLocal(ctx context.Context, flags *cliFlags) (*server.Server, func(), error) {
-	db, err := dialLocalSQL(flags)
-	if err != nil {
-		return nil, nil, err
-	}
-	bucket, err := localBucket(flags)
-	if err != nil {
-		return nil, nil, err
-	}
-	variable, cleanup, err := localRuntimeVar(flags)
-	if err != nil {
 		return nil, nil, err
 	}
-	mainApplication := newApplication(db, bucket, variable)
-	router := newRouter(mainApplication)
-	logger := _wireRequestlogLoggerValue
-	v, cleanup2 := appHealthChecks(db)
-	exporter := _wireTraceExporterValue
-	sampler := trace.AlwaysSample()
-	defaultDriver := _wireDefaultDriverValue
-	options := &server.Options{
-		RequestLogger:         logger,
-		HealthChecks:          v,
-		TraceExporter:         exporter,
-		DefaultSamplingPolicy: sampler,
-		Driver:                defaultDriver,
-	}
-	serverServer := server.New(router, options)
-	return serverServer, func() {
+	mainGuestbook := newGuestbook(serverServer, mainBackups)
+	return mainGuestbook, func() {
+		cleanup16()
+		cleanup15()
+		cleanup14()
+		cleanup13()
+		cleanup12()
+		cleanup11()
+		cleanup10()
+		cleanup9()
+		cleanup8()
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
 		cleanup2()
 		cleanup()
 	}, nil
 }
 
 var (
-	_wireRequestlogLoggerValue = requestlog.Logger(nil)
-	_wireTraceExporterValue    = trace.Exporter(nil)
+	_wireDefaultDriverValue = &server.DefaultDriver{}
 )
-
-// inject_aws.go:
-
-// awsBucket is a Wire provider function that returns the S3 bucket based on the
-// command-line flags.
-func awsBucket(ctx context.Context, cp client.ConfigProvider, flags *cliFlags) (*blob.Bucket, func(), error) {
-	b, err := s3blob.OpenBucket(ctx, cp, flags.bucket, nil)
-	if err != nil {
-		return nil, nil, err
-	}
-	return b, func() { b.Close() }, nil
-}
-
-// openAWSDatabase is a Wire provider function that connects to an AWS RDS
-// MySQL database based on the command-line flags.
-func openAWSDatabase(ctx context.Context, opener *awsmysql.URLOpener, flags *cliFlags) (*sql.DB, func(), error) {
-	db, err := opener.OpenMySQLURL(ctx, &url.URL{
-		Scheme: "awsmysql",
-		User:   url.UserPassword(flags.dbUser, flags.dbPassword),
-		Host:   flags.dbHost,
-		Path:   "/" + flags.dbName,
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-	return db, func() { db.Close() }, nil
-}
-
-// awsMOTDVar is a Wire provider function that returns the Message of the Day
-// variable from SSM Parameter Store.
-func awsMOTDVar(ctx context.Context, sess client.ConfigProvider, flags *cliFlags) (*runtimevar.Variable, error) {
-	return awsparamstore.OpenVariable(sess, flags.motdVar, runtimevar.StringDecoder, &awsparamstore.Options{
-		WaitDuration: flags.motdVarWaitTime,
-	})
-}
-
-// inject_azure.go:
-
-func bucketName(flags *cliFlags) azureblob.ContainerName {
-	return azureblob.ContainerName(flags.bucket)
-}
-
-// azureBucket is a Wire provider function that returns the Azure bucket based
-// on the command-line flags.
-func azureBucket(ctx context.Context, client2 *container.Client, flags *cliFlags) (*blob.Bucket, func(), error) {
-	b, err := azureblob.OpenBucket(ctx, client2, nil)
-	if err != nil {
-		return nil, nil, err
-	}
-	return b, func() { b.Close() }, nil
-}
-
-// azureMOTDVar is a Wire provider function that returns the Message of the Day
-// variable read from a blob stored in Azure.
-func azureMOTDVar(ctx context.Context, b *blob.Bucket, flags *cliFlags) (*runtimevar.Variable, error) {
-	return blobvar.OpenVariable(b, flags.motdVar, runtimevar.StringDecoder, &blobvar.Options{
-		WaitDuration: flags.motdVarWaitTime,
-	})
-}
-
-// inject_gcp.go:
-
-// gcpBucket is a Wire provider function that returns the GCS bucket based on
-// the command-line flags.
-func gcpBucket(ctx context.Context, flags *cliFlags, client2 *gcp.HTTPClient) (*blob.Bucket, func(), error) {
-	b, err := gcsblob.OpenBucket(ctx, client2, flags.bucket, nil)
-	if err != nil {
-		return nil, nil, err
-	}
-	return b, func() { b.Close() }, nil
-}
-
-// openGCPDatabase is a Wire provider function that connects to a GCP Cloud SQL
-// MySQL database based on the command-line flags.
-func openGCPDatabase(ctx context.Context, opener *gcpmysql.URLOpener, id gcp.ProjectID, flags *cliFlags) (*sql.DB, func(), error) {
-	db, err := opener.OpenMySQLURL(ctx, &url.URL{
-		Scheme: "gcpmysql",
-		User:   url.UserPassword(flags.dbUser, flags.dbPassword),
-		Host:   string(id),
-		Path:   fmt.Sprintf("/%s/%s/%s", flags.cloudSQLRegion, flags.dbHost, flags.dbName),
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-	return db, func() { db.Close() }, nil
-}
-
-// gcpMOTDVar is a Wire provider function that returns the Message of the Day
-// variable from Runtime Configurator.
-func gcpMOTDVar(ctx context.Context, client2 runtimeconfig.RuntimeConfigManagerClient, project gcp.ProjectID, flags *cliFlags) (*runtimevar.Variable, func(), error) {
-	variableKey := gcpruntimeconfig.VariableKey(project, flags.runtimeConfigName, flags.motdVar)
-	v, err := gcpruntimeconfig.OpenVariable(client2, variableKey, runtimevar.StringDecoder, &gcpruntimeconfig.Options{
-		WaitDuration: flags.motdVarWaitTime,
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-	return v, func() { v.Close() }, nil
-}
-
-// inject_local.go:
-
-// localBucket is a Wire provider function that returns a directory-based bucket
-// based on the command-line flags.
-func localBucket(flags *cliFlags) (*blob.Bucket, error) {
-	return fileblob.OpenBucket(flags.bucket, nil)
-}
-
-// dialLocalSQL is a Wire provider function that connects to a MySQL database
-// (usually on localhost).
-func dialLocalSQL(flags *cliFlags) (*sql.DB, error) {
-	cfg := &mysql.Config{
-		Net:                  "tcp",
-		Addr:                 flags.dbHost,
-		DBName:               flags.dbName,
-		User:                 flags.dbUser,
-		Passwd:               flags.dbPassword,
-		AllowNativePasswords: true,
-	}
-	return sql.Open("mysql", cfg.FormatDSN())
-}
-
-// localRuntimeVar is a Wire provider function that returns the Message of the
-// Day variable based on a local file.
-func localRuntimeVar(flags *cliFlags) (*runtimevar.Variable, func(), error) {
-	v, err := filevar.OpenVariable(flags.motdVar, runtimevar.StringDecoder, &filevar.Options{
-		WaitDuration: flags.motdVarWaitTime,
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-	return v, func() { v.Close() }, nil
-}
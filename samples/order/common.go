@@ -15,18 +15,24 @@
 package main
 
 import (
+	"fmt"
 	"time"
 )
 
-// Order represents an order for a single image operation.
+// Order represents an order for processing a single image.
 type Order struct {
-	ID               string    // unique ID, randomly generated
-	Email            string    // email address of customer
-	InImage          string    // name of input image
-	OutImage         string    // name of output image; empty if there was an error
-	CreateTime       time.Time // time the order was created
-	FinishTime       time.Time // time the order was finished
-	Note             string    // note to the customer from the processor, describing success or error
+	ID               string      // unique ID, randomly generated
+	Email            string      // email address of customer
+	InImage          string      // name of input image
+	OutImage         string      // name of output image; empty if there was an error
+	Operations       []Operation // operations to apply to the image, in order
+	CreateTime       time.Time   // time the order was created
+	FinishTime       time.Time   // time the order was finished
+	Note             string      // note to the customer from the processor, describing success or error
+	Attempts         int         // number of times a processor has started on the order
+	Failed           bool        // whether the processor gave up on the order
+	LeaseOwner       string      // ID of the processor working on the order; empty if none
+	LeaseExpiry      time.Time   // when LeaseOwner's claim on the order lapses unless renewed
 	DocstoreRevision interface{}
 }
 
@@ -36,5 +42,45 @@ type OrderRequest struct {
 	ID         string
 	Email      string
 	InImage    string
+	Operations []Operation
 	CreateTime time.Time
 }
+
+// Names of operations.
+const (
+	opResize    = "resize"    // scale to Width x Height; a zero dimension keeps the aspect ratio
+	opCrop      = "crop"      // keep the Width x Height rectangle at X, Y
+	opRotate    = "rotate"    // rotate clockwise by Degrees, a multiple of 90
+	opGrayscale = "grayscale" // remove color
+	opThumbnail = "thumbnail" // shrink to fit in Width x Height, keeping the aspect ratio
+	opFormat    = "format"    // encode the output as Format, with Quality for JPEG
+)
+
+// An Operation is one step in processing an image. Which fields are used
+// depends on Name.
+type Operation struct {
+	Name          string
+	Width, Height int    // resize, crop, thumbnail
+	X, Y          int    // crop
+	Degrees       int    // rotate
+	Format        string // format: "png", "jpeg" or "gif"
+	Quality       int    // format: JPEG quality from 1 to 100; 0 means the default
+}
+
+// String describes the operation for notes to the customer.
+func (op Operation) String() string {
+	switch op.Name {
+	case opResize, opThumbnail:
+		return fmt.Sprintf("%s %dx%d", op.Name, op.Width, op.Height)
+	case opCrop:
+		return fmt.Sprintf("crop %dx%d+%d+%d", op.Width, op.Height, op.X, op.Y)
+	case opRotate:
+		return fmt.Sprintf("rotate %d", op.Degrees)
+	case opFormat:
+		if op.Quality != 0 {
+			return fmt.Sprintf("format %s quality %d", op.Format, op.Quality)
+		}
+		return "format " + op.Format
+	}
+	return op.Name
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -25,6 +26,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -66,7 +68,7 @@ func init() {
 	orderFormTemplate = template.Must(template.ParseFiles(filepath.Join(dir, "order-form.htmlt")))
 }
 
-// run starts the server on port and runs it indefinitely.
+// run starts the server on port and runs it until ctx is done.
 func (f *frontend) run(ctx context.Context, port int) error {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "index.html") })
 	http.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "style.css") })
@@ -79,7 +81,16 @@ func (f *frontend) run(ctx context.Context, port int) error {
 	s := server.New(nil, &server.Options{
 		RequestLogger: rl,
 	})
-	return s.ListenAndServe(fmt.Sprintf(":%d", port))
+	go func() {
+		<-ctx.Done()
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Printf("shutting down: %v", err)
+		}
+	}()
+	if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
 // wrapHTTPError turns handlers that return error into ordinary http.Handlers,
@@ -113,24 +124,144 @@ func (f *frontend) createOrder(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	ops, err := parseOperations(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
 	file, _, err := r.FormFile("file")
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	if _, err := f.doCreateOrder(r.Context(), email, file, time.Now()); err != nil {
+	if _, err := f.doCreateOrder(r.Context(), email, ops, file, time.Now()); err != nil {
 		return err
 	}
 	fmt.Fprintln(w, "Order received. Thank you.")
 	return nil
 }
 
+// parseOperations returns the image operations in the order form. The form
+// has a row for each step, with an "op" field naming the operation and an
+// "arg" field holding its argument, such as "100x50+0+10" for crop. The
+// operations are applied in the order of the rows; rows without an operation
+// are skipped.
+func parseOperations(r *http.Request) ([]Operation, error) {
+	// ParseMultipartForm also parses URL-encoded forms.
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	names, args := r.Form["op"], r.Form["arg"]
+	var ops []Operation
+	for i, name := range names {
+		var arg string
+		if i < len(args) {
+			arg = strings.TrimSpace(args[i])
+		}
+		if name == "" {
+			if arg != "" {
+				return nil, fmt.Errorf("step %d: %q has no operation", i+1, arg)
+			}
+			continue
+		}
+		op, err := parseOperation(name, arg)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %v", i+1, err)
+		}
+		ops = append(ops, op)
+	}
+	if err := validateOperations(ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// maxFormMemory is how much of an order form is kept in memory; the rest of
+// the uploaded file is stored in temporary files.
+const maxFormMemory = 32 << 20
+
+// parseOperation returns the operation with the given name and argument:
+//
+//	crop       WIDTHxHEIGHT or WIDTHxHEIGHT+X+Y
+//	resize     WIDTHxHEIGHT, WIDTHx or xHEIGHT
+//	thumbnail  WIDTHxHEIGHT or SIZE
+//	rotate     DEGREES
+//	grayscale  (none)
+//	format     png, gif, jpeg or jpeg QUALITY
+func parseOperation(name, arg string) (Operation, error) {
+	op := Operation{Name: name}
+	var err error
+	switch name {
+	case opCrop:
+		size, origin, hasOrigin := strings.Cut(arg, "+")
+		op.Width, op.Height, err = parseSize(size)
+		if err == nil && hasOrigin {
+			x, y, ok := strings.Cut(origin, "+")
+			if !ok {
+				err = errors.New("want WIDTHxHEIGHT+X+Y")
+			} else if op.X, err = strconv.Atoi(x); err == nil {
+				op.Y, err = strconv.Atoi(y)
+			}
+		}
+	case opResize:
+		op.Width, op.Height, err = parseSize(arg)
+	case opThumbnail:
+		if !strings.Contains(arg, "x") {
+			arg = arg + "x" + arg
+		}
+		op.Width, op.Height, err = parseSize(arg)
+	case opRotate:
+		op.Degrees, err = strconv.Atoi(arg)
+	case opGrayscale:
+		if arg != "" {
+			err = errors.New("takes no argument")
+		}
+	case opFormat:
+		switch f := strings.Fields(arg); len(f) {
+		case 1:
+			op.Format = f[0]
+		case 2:
+			op.Format = f[0]
+			op.Quality, err = strconv.Atoi(f[1])
+		default:
+			err = errors.New("want FORMAT or jpeg QUALITY")
+		}
+	default:
+		return Operation{}, fmt.Errorf("unknown operation %q", name)
+	}
+	if err != nil {
+		return Operation{}, fmt.Errorf("%s %q: %v", name, arg, err)
+	}
+	return op, nil
+}
+
+// parseSize parses a size of the form WIDTHxHEIGHT. A missing dimension is
+// zero.
+func parseSize(s string) (w, h int, err error) {
+	ws, hs, ok := strings.Cut(s, "x")
+	if !ok {
+		return 0, 0, errors.New("want WIDTHxHEIGHT")
+	}
+	if ws != "" {
+		if w, err = strconv.Atoi(ws); err != nil {
+			return 0, 0, err
+		}
+	}
+	if hs != "" {
+		if h, err = strconv.Atoi(hs); err != nil {
+			return 0, 0, err
+		}
+	}
+	return w, h, nil
+}
+
 // doCreateOrder creates a new order.
-// It is passed the customer's email address, an io.Reader for reading the input
-// image, and the current time.
+// It is passed the customer's email address, the operations to apply, an
+// io.Reader for reading the input image, and the current time.
 // It creates an Order in the database and sends an OrderRequest over the pub/sub topic.
 // It returns the order ID it generates, for testing.
-func (f *frontend) doCreateOrder(ctx context.Context, email string, file io.Reader, now time.Time) (id string, err error) {
+func (f *frontend) doCreateOrder(ctx context.Context, email string, ops []Operation, file io.Reader, now time.Time) (id string, err error) {
 	// Assign an ID for the order here, rather than in the processor.
 	// That allows the processor to detect duplicate pub/sub messages.
 	id = f.newID()
@@ -138,6 +269,7 @@ func (f *frontend) doCreateOrder(ctx context.Context, email string, file io.Read
 		ID:         id,
 		InImage:    id + "-in",
 		Email:      email,
+		Operations: ops,
 		CreateTime: now,
 	}
 
@@ -17,13 +17,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"gocloud.dev/docstore"
 )
 
@@ -70,7 +73,7 @@ func TestCreateOrder(t *testing.T) {
 	ctx := context.Background()
 	file := strings.NewReader("an image")
 	tm := time.Date(2019, 7, 1, 0, 0, 0, 0, time.Local)
-	id, err := f.doCreateOrder(ctx, "pat@example.com", file, tm)
+	id, err := f.doCreateOrder(ctx, "pat@example.com", nil, file, tm)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,6 +94,86 @@ func TestCreateOrder(t *testing.T) {
 	}
 }
 
+func TestParseOperations(t *testing.T) {
+	for _, test := range []struct {
+		ops, args []string
+		want      []Operation
+		wantErr   bool
+	}{
+		{want: nil},
+		{ops: []string{"", ""}, args: []string{"", " "}, want: nil},
+		{
+			ops:  []string{"rotate", "", "crop", "resize", "thumbnail", "grayscale", "format"},
+			args: []string{"270", "", "100x50+0+10", "200x", "64", "", "jpeg 80"},
+			// In the order of the steps, skipping empty ones.
+			want: []Operation{
+				{Name: opRotate, Degrees: 270},
+				{Name: opCrop, X: 0, Y: 10, Width: 100, Height: 50},
+				{Name: opResize, Width: 200},
+				{Name: opThumbnail, Width: 64, Height: 64},
+				{Name: opGrayscale},
+				{Name: opFormat, Format: "jpeg", Quality: 80},
+			},
+		},
+		{ops: []string{"crop", "thumbnail"}, args: []string{"10x20", "30x40"}, want: []Operation{
+			{Name: opCrop, Width: 10, Height: 20},
+			{Name: opThumbnail, Width: 30, Height: 40},
+		}},
+		{ops: []string{"format"}, args: []string{"gif"}, want: []Operation{{Name: opFormat, Format: "gif"}}},
+		{ops: []string{"resize"}, args: []string{"widex"}, wantErr: true},
+		{ops: []string{"resize"}, args: []string{"200"}, wantErr: true},
+		{ops: []string{"resize"}, args: []string{"100000x"}, wantErr: true},
+		{ops: []string{"crop"}, args: []string{"10x"}, wantErr: true},
+		{ops: []string{"crop"}, args: []string{"10x10+5"}, wantErr: true},
+		{ops: []string{"rotate"}, args: []string{"45"}, wantErr: true},
+		{ops: []string{"grayscale"}, args: []string{"yes"}, wantErr: true},
+		{ops: []string{"format"}, args: []string{"bmp"}, wantErr: true},
+		{ops: []string{"format"}, args: []string{"png 80"}, wantErr: true},
+		{ops: []string{"format", "format"}, args: []string{"png", "gif"}, wantErr: true},
+		{ops: []string{"sharpen"}, args: []string{""}, wantErr: true},
+		{ops: []string{""}, args: []string{"90"}, wantErr: true},
+	} {
+		form := url.Values{"op": test.ops, "arg": test.args}
+		r := httptest.NewRequest("POST", "/createOrder", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		got, err := parseOperations(r)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: got error %v, want error %t", form, err, test.wantErr)
+			continue
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("%v:\ngot  %+v\nwant %+v", form, got, test.want)
+		}
+	}
+}
+
+func TestParseOperationsOrder(t *testing.T) {
+	// Rotating a 100x50 image and then cropping it gives a different size
+	// than cropping it first.
+	for _, test := range []struct {
+		ops, args []string
+		want      image.Point
+	}{
+		{[]string{"rotate", "crop"}, []string{"90", "40x80"}, image.Pt(40, 80)},
+		{[]string{"crop", "rotate"}, []string{"40x80", "90"}, image.Pt(50, 40)},
+	} {
+		form := url.Values{"op": test.ops, "arg": test.args}
+		r := httptest.NewRequest("POST", "/createOrder", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ops, err := parseOperations(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := applyOperations(image.NewRGBA(image.Rect(0, 0, 100, 50)), ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Size(); got != test.want {
+			t.Errorf("%v: got a %v image, want %v", form, got, test.want)
+		}
+	}
+}
+
 func TestListOrders(t *testing.T) {
 	f, _, cleanup, err := setup(testConfig("ListOrders"))
 	if err != nil {
@@ -153,6 +236,9 @@ func testConfig(name string) config {
 		requestSubURL:   reqURL,
 		bucketURL:       "", // setup will use fileblob with a temporary dir
 		collectionURL:   fmt.Sprintf("mem://orders-%s/ID", name),
+		deadLetterURL:   "mem://dead-letters-" + name,
+		maxAttempts:     3,
+		leaseDuration:   time.Minute,
 	}
 }
 
@@ -0,0 +1,278 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The image operations that can be ordered. They use only the standard
+// library, and favor simplicity over speed and quality.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// maxDimension is the largest width or height an operation may produce, to
+// keep a single order from using too much memory.
+const maxDimension = 4096
+
+// validateOperations reports whether ops is a list of operations that can be
+// applied to an image.
+func validateOperations(ops []Operation) error {
+	formats := 0
+	for _, op := range ops {
+		if err := op.validate(); err != nil {
+			return fmt.Errorf("%s: %v", op.Name, err)
+		}
+		if op.Name == opFormat {
+			formats++
+		}
+	}
+	if formats > 1 {
+		return errors.New("more than one output format")
+	}
+	return nil
+}
+
+func (op Operation) validate() error {
+	checkSize := func(w, h int, zeroOK bool) error {
+		if w < 0 || h < 0 || w > maxDimension || h > maxDimension {
+			return fmt.Errorf("size %dx%d out of range", w, h)
+		}
+		if (w == 0 && h == 0) || (!zeroOK && (w == 0 || h == 0)) {
+			return fmt.Errorf("missing width or height")
+		}
+		return nil
+	}
+	switch op.Name {
+	case opResize:
+		return checkSize(op.Width, op.Height, true)
+	case opThumbnail:
+		return checkSize(op.Width, op.Height, false)
+	case opCrop:
+		if op.X < 0 || op.Y < 0 {
+			return fmt.Errorf("negative origin %d,%d", op.X, op.Y)
+		}
+		return checkSize(op.Width, op.Height, false)
+	case opRotate:
+		if op.Degrees%90 != 0 {
+			return fmt.Errorf("%d degrees is not a multiple of 90", op.Degrees)
+		}
+		return nil
+	case opGrayscale:
+		return nil
+	case opFormat:
+		switch op.Format {
+		case "png", "gif":
+			if op.Quality != 0 {
+				return fmt.Errorf("quality only applies to jpeg")
+			}
+			return nil
+		case "jpeg":
+			if op.Quality < 0 || op.Quality > 100 {
+				return fmt.Errorf("quality %d out of range", op.Quality)
+			}
+			return nil
+		}
+		return fmt.Errorf("unknown format %q", op.Format)
+	}
+	return errors.New("unknown operation")
+}
+
+// applyOperations applies ops to img in order. Format operations don't change
+// the image; see outputFormat.
+func applyOperations(img image.Image, ops []Operation) (image.Image, error) {
+	for _, op := range ops {
+		switch op.Name {
+		case opResize:
+			w, h := op.Width, op.Height
+			b := img.Bounds()
+			if w == 0 {
+				w = scaleDim(b.Dx(), h, b.Dy())
+			} else if h == 0 {
+				h = scaleDim(b.Dy(), w, b.Dx())
+			}
+			if w > maxDimension || h > maxDimension {
+				return nil, fmt.Errorf("resize: size %dx%d out of range", w, h)
+			}
+			img = resize(img, w, h)
+		case opThumbnail:
+			img = thumbnail(img, op.Width, op.Height)
+		case opCrop:
+			b := img.Bounds()
+			r := image.Rect(op.X, op.Y, op.X+op.Width, op.Y+op.Height).Add(b.Min).Intersect(b)
+			if r.Empty() {
+				return nil, fmt.Errorf("crop: %v is outside the %dx%d image", op, b.Dx(), b.Dy())
+			}
+			img = crop(img, r)
+		case opRotate:
+			img = rotate(img, op.Degrees)
+		case opGrayscale:
+			img = grayscale(img)
+		}
+	}
+	return img, nil
+}
+
+// outputFormat returns the format operation in ops, or PNG if there is none.
+func outputFormat(ops []Operation) Operation {
+	for _, op := range ops {
+		if op.Name == opFormat {
+			return op
+		}
+	}
+	return Operation{Name: opFormat, Format: "png"}
+}
+
+// encode writes img to w in the format of op.
+func encode(w io.Writer, img image.Image, op Operation) error {
+	switch op.Format {
+	case "jpeg":
+		q := op.Quality
+		if q == 0 {
+			q = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: q})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	}
+	return png.Encode(w, img)
+}
+
+// scaleDim returns n scaled by num/den, rounded and at least 1.
+func scaleDim(n, num, den int) int {
+	s := (n*num + den/2) / den
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
+
+// toRGBA returns img as an *image.RGBA whose bounds start at (0, 0).
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	if m, ok := img.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return m
+	}
+	m := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(m, m.Bounds(), img, b.Min, draw.Src)
+	return m
+}
+
+// resize scales img to w x h with bilinear interpolation.
+func resize(img image.Image, w, h int) *image.RGBA {
+	src := toRGBA(img)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		// Map the center of the destination pixel into the source.
+		fy := (float64(y)+0.5)*float64(sh)/float64(h) - 0.5
+		y0, wy := split(fy, sh)
+		for x := 0; x < w; x++ {
+			fx := (float64(x)+0.5)*float64(sw)/float64(w) - 0.5
+			x0, wx := split(fx, sw)
+			x1, y1 := min(x0+1, sw-1), min(y0+1, sh-1)
+			p00 := src.PixOffset(x0, y0)
+			p10 := src.PixOffset(x1, y0)
+			p01 := src.PixOffset(x0, y1)
+			p11 := src.PixOffset(x1, y1)
+			d := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				top := float64(src.Pix[p00+c])*(1-wx) + float64(src.Pix[p10+c])*wx
+				bottom := float64(src.Pix[p01+c])*(1-wx) + float64(src.Pix[p11+c])*wx
+				dst.Pix[d+c] = uint8(top*(1-wy) + bottom*wy + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
+// split returns the integer part of f, clamped to [0, n-1], and the weight of
+// the next pixel.
+func split(f float64, n int) (int, float64) {
+	if f <= 0 {
+		return 0, 0
+	}
+	i := int(f)
+	if i >= n-1 {
+		return n - 1, 0
+	}
+	return i, f - float64(i)
+}
+
+// thumbnail shrinks img to fit in w x h, keeping its aspect ratio. Images that
+// already fit are returned unchanged.
+func thumbnail(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= w && b.Dy() <= h {
+		return img
+	}
+	// Scale by the smaller of w/dx and h/dy.
+	if w*b.Dy() <= h*b.Dx() {
+		return resize(img, w, scaleDim(b.Dy(), w, b.Dx()))
+	}
+	return resize(img, scaleDim(b.Dx(), h, b.Dy()), h)
+}
+
+// crop returns the part of img in r.
+func crop(img image.Image, r image.Rectangle) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// rotate rotates img clockwise by a multiple of 90 degrees.
+func rotate(img image.Image, degrees int) image.Image {
+	turns := ((degrees/90)%4 + 4) % 4
+	if turns == 0 {
+		return img
+	}
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	var dst *image.RGBA
+	if turns == 2 {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch turns {
+			case 1:
+				dx, dy = h-1-y, x
+			case 2:
+				dx, dy = w-1-x, h-1-y
+			case 3:
+				dx, dy = y, w-1-x
+			}
+			s, d := src.PixOffset(x, y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+	return dst
+}
+
+// grayscale returns img without color.
+func grayscale(img image.Image) *image.Gray {
+	b := img.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// The images in these tests are described by strings, with one letter per
+// pixel and a space between rows. The letters are the initials of the colors
+// in palette.
+var palette = map[byte]color.RGBA{
+	'r': {255, 0, 0, 255},
+	'g': {0, 255, 0, 255},
+	'b': {0, 0, 255, 255},
+	'c': {0, 255, 255, 255},
+	'm': {255, 0, 255, 255},
+	'y': {255, 255, 0, 255},
+	'k': {0, 0, 0, 255},
+	'w': {255, 255, 255, 255},
+}
+
+// makeImage returns the image described by s, such as "rgb cmy".
+func makeImage(s string) *image.RGBA {
+	var rows [][]byte
+	for _, row := range strings.Fields(s) {
+		rows = append(rows, []byte(row))
+	}
+	m := image.NewRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, p := range row {
+			m.Set(x, y, palette[p])
+		}
+	}
+	return m
+}
+
+// describe returns the string that describes img, with a "?" for each color
+// not in palette.
+func describe(img image.Image) string {
+	var s []byte
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		if y > b.Min.Y {
+			s = append(s, ' ')
+		}
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			p := byte('?')
+			for k, v := range palette {
+				if v == c {
+					p = k
+				}
+			}
+			s = append(s, p)
+		}
+	}
+	return string(s)
+}
+
+func TestApplyOperations(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		ops  []Operation
+		want string
+	}{
+		{"rgb cmy", nil, "rgb cmy"},
+		{"rgb cmy", []Operation{{Name: opRotate, Degrees: 90}}, "cr mg yb"},
+		{"rgb cmy", []Operation{{Name: opRotate, Degrees: 180}}, "ymc bgr"},
+		{"rgb cmy", []Operation{{Name: opRotate, Degrees: 270}}, "by gm rc"},
+		{"rgb cmy", []Operation{{Name: opRotate, Degrees: -90}}, "by gm rc"},
+		{"rgb cmy", []Operation{{Name: opRotate, Degrees: 360}}, "rgb cmy"},
+		{"rgb cmy", []Operation{{Name: opCrop, X: 1, Y: 1, Width: 5, Height: 5}}, "my"},
+		{"rgb cmy", []Operation{{Name: opCrop, X: 1, Width: 2, Height: 1}, {Name: opRotate, Degrees: 90}}, "g b"},
+		// Enlarging keeps the corners and blends the rest.
+		{"rg by", []Operation{{Name: opResize, Width: 4, Height: 4}}, "r??g ???? ???? b??y"},
+		{"rgbc myrg", []Operation{{Name: opResize, Width: 2, Height: 1}}, "??"},
+		// A zero height keeps the aspect ratio.
+		{"kw", []Operation{{Name: opResize, Width: 4}}, "k??w k??w"},
+		{"wk", []Operation{{Name: opGrayscale}}, "wk"},
+		{"rw", []Operation{{Name: opGrayscale}, {Name: opCrop, X: 1, Width: 1, Height: 1}}, "w"},
+		{"kkkk kkkk", []Operation{{Name: opThumbnail, Width: 2, Height: 2}}, "kk"},
+	} {
+		got, err := applyOperations(makeImage(test.in), test.ops)
+		if err != nil {
+			t.Errorf("%s %v: %v", test.in, test.ops, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, describe(got)); diff != "" {
+			t.Errorf("%s %v (-want +got):\n%s", test.in, test.ops, diff)
+		}
+	}
+}
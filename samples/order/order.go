@@ -12,11 +12,12 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// This application processes orders for converting images to PNG format. It
-// consists of two components: a frontend, which serves web pages that people
-// can use to place and view orders; and a processor, which performs the
-// conversions. This binary can run both together in one process (the default),
-// or it can run either on its own. Either way, the two components:
+// This application processes orders for converting images, for example by
+// resizing them or changing their format. It consists of two components: a
+// frontend, which serves web pages that people can use to place and view
+// orders; and a processor, which performs the conversions. This binary can
+// run both together in one process (the default), or it can run either on its
+// own. Either way, the two components:
 //   - communicate over a topic using the gocloud.dev/pubsub API;
 //   - write orders to a database using the gocloud.dev/docstore API;
 //   - and save image files to cloud storage using the gocloud.dev/blob API.
@@ -28,10 +29,15 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"gocloud.dev/blob"
 	"gocloud.dev/docstore"
@@ -43,6 +49,10 @@ var (
 	requestSubURL   = flag.String("request-sub", "mem://requests", "gocloud.dev/pubsub URL for request subscription")
 	bucketURL       = flag.String("bucket", "", "gocloud.dev/blob URL for image bucket")
 	collectionURL   = flag.String("collection", "mem://orders/ID", "gocloud.dev/docstore URL for order collection")
+	deadLetterURL   = flag.String("dead-letter-topic", "", "gocloud.dev/pubsub URL for the topic that receives requests the processor gives up on; if empty, they are only logged")
+	maxAttempts     = flag.Int("max-attempts", 5, "number of times the processor may start on an order before giving up on it")
+	workers         = flag.Int("workers", 1, "number of requests the processor handles concurrently")
+	leaseDuration   = flag.Duration("lease", 30*time.Second, "how long a processor's claim on an order lasts unless renewed; another processor takes over orders whose lease expired")
 
 	port         = flag.Int("port", 10538, "HTTP port for frontend")
 	runFrontend  = flag.Bool("frontend", true, "run the frontend")
@@ -56,6 +66,13 @@ func main() {
 		requestSubURL:   *requestSubURL,
 		bucketURL:       *bucketURL,
 		collectionURL:   *collectionURL,
+		deadLetterURL:   *deadLetterURL,
+		maxAttempts:     *maxAttempts,
+		workers:         *workers,
+		leaseDuration:   *leaseDuration,
+	}
+	if err := conf.validate(); err != nil {
+		log.Fatal(err)
 	}
 	frontend, processor, cleanup, err := setup(conf)
 	if err != nil {
@@ -63,19 +80,24 @@ func main() {
 	}
 	defer cleanup()
 
+	// Stop gracefully on an interrupt: the frontend stops serving, and the
+	// processor finishes the requests it has started.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Run the frontend, or the processor, or both.
 	// When we want to run both, one of them has to run in a goroutine.
 	// So it's simpler to run both in goroutines, even if we only need
 	// to run one.
 	errc := make(chan error, 2)
 	if *runFrontend {
-		go func() { errc <- frontend.run(context.Background(), *port) }()
+		go func() { errc <- frontend.run(ctx, *port) }()
 		log.Printf("listening on port %d", *port)
 	} else {
 		errc <- nil
 	}
 	if *runProcessor {
-		go func() { errc <- processor.run(context.Background()) }()
+		go func() { errc <- processor.run(ctx) }()
 		log.Println("processing")
 	} else {
 		errc <- nil
@@ -94,6 +116,28 @@ type config struct {
 	requestSubURL   string
 	bucketURL       string
 	collectionURL   string
+	deadLetterURL   string // may be empty
+	maxAttempts     int
+	workers         int
+	leaseDuration   time.Duration
+}
+
+// minLeaseDuration is the shortest lease a processor may take on an order.
+// Processors renew their leases several times per lease duration.
+const minLeaseDuration = time.Millisecond
+
+// validate checks the numbers in conf that come from command-line flags.
+func (conf config) validate() error {
+	if conf.maxAttempts <= 0 {
+		return fmt.Errorf("-max-attempts must be positive, not %d", conf.maxAttempts)
+	}
+	if conf.workers <= 0 {
+		return fmt.Errorf("-workers must be positive, not %d", conf.workers)
+	}
+	if conf.leaseDuration < minLeaseDuration {
+		return fmt.Errorf("-lease must be at least %v, not %v", minLeaseDuration, conf.leaseDuration)
+	}
+	return nil
 }
 
 // setup opens all the necessary resources for the application.
@@ -151,15 +195,32 @@ func setup(conf config) (_ *frontend, _ *processor, cleanup func(), err error) {
 	}
 	addCleanup(func() { coll.Close() })
 
+	var deadLetterTopic *pubsub.Topic
+	if conf.deadLetterURL != "" {
+		deadLetterTopic, err = pubsub.OpenTopic(ctx, conf.deadLetterURL)
+		if err != nil {
+			return nil, nil, cleanup, err
+		}
+		addCleanup(func() { deadLetterTopic.Shutdown(ctx) })
+	}
+
 	f := &frontend{
 		requestTopic: reqTopic,
 		bucket:       bucket,
 		coll:         coll,
 	}
 	p := &processor{
-		requestSub: reqSub,
-		bucket:     bucket,
-		coll:       coll,
+		requestSub:      reqSub,
+		bucket:          bucket,
+		coll:            coll,
+		deadLetterTopic: deadLetterTopic,
+		maxAttempts:     conf.maxAttempts,
+		workers:         conf.workers,
+		id:              newProcessorID(),
+		leaseDuration:   conf.leaseDuration,
+		minBackoff:      time.Second,
+		maxBackoff:      time.Minute,
+		delay:           func() time.Duration { return time.Duration(rand.Intn(5)+2) * time.Second },
 	}
 	return f, p, cleanup, nil
 }
@@ -0,0 +1,39 @@
+// Copyright 2024 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	good := config{maxAttempts: 5, workers: 1, leaseDuration: 30 * time.Second}
+	if err := good.validate(); err != nil {
+		t.Errorf("%+v: %v", good, err)
+	}
+	for _, change := range []func(*config){
+		func(c *config) { c.maxAttempts = 0 },
+		func(c *config) { c.workers = -1 },
+		func(c *config) { c.leaseDuration = 0 },
+		func(c *config) { c.leaseDuration = 2 * time.Nanosecond },
+	} {
+		bad := good
+		change(&bad)
+		if err := bad.validate(); err == nil {
+			t.Errorf("%+v: got nil, want error", bad)
+		}
+	}
+}
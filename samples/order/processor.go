@@ -16,20 +16,25 @@
 // subscribing to the requests topic, and writes responses to the response
 // topic.
 //
-// At present, it just encodes input images into PNG format.
+// It applies the operations in each order to the input image, and encodes the
+// result as PNG unless the order asks for another format.
 
 package main
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	_ "image/gif"
 	_ "image/jpeg"
-	"image/png"
+	_ "image/png"
 	"log"
 	"math/rand"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"gocloud.dev/blob"
@@ -46,49 +51,119 @@ type processor struct {
 	requestSub *pubsub.Subscription
 	bucket     *blob.Bucket
 	coll       *docstore.Collection
+	// deadLetterTopic receives the requests the processor gives up on. If it
+	// is nil, they are only logged.
+	deadLetterTopic *pubsub.Topic
+	// maxAttempts is how many times processing an order may start before
+	// the processor gives up on it.
+	maxAttempts int
+	// minBackoff and maxBackoff bound how long a request that failed waits
+	// before it is redelivered. The wait doubles with each attempt.
+	minBackoff, maxBackoff time.Duration
+	// workers is the number of requests to handle concurrently.
+	workers int
+	// id identifies the processor in the leases it holds on orders. It must
+	// be unique among the processors sharing the collection.
+	id string
+	// leaseDuration is how long a claim on an order lasts unless it is
+	// renewed. Processors renew their leases while they work, so an order
+	// whose lease has expired was abandoned, and another processor may take
+	// it over.
+	leaseDuration time.Duration
+	// delay returns how long to pretend that processing an order takes. If
+	// it is nil, there is no delay.
+	delay func() time.Duration
+
+	mu         sync.Mutex
+	inProgress map[string]bool // IDs of the orders being processed
+	// dbFailures counts, for each order, the requests for it in a row that
+	// failed because of database errors, so that their retries back off.
+	dbFailures map[string]int
 }
 
-// run handles requests until the context is done or there is a fatal error.
+// run handles requests with p.workers concurrent workers until the context is
+// done or the subscription fails. When the context is done, run stops
+// receiving requests, waits for the ones in progress to finish, and returns
+// nil.
 func (p *processor) run(ctx context.Context) error {
-	for {
-		if err := p.handleRequest(ctx); err != nil {
-			return err
-		}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i := 0; i < max(p.workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := p.handleRequest(ctx)
+				if err == nil {
+					continue
+				}
+				if ctx.Err() == nil {
+					// The subscription failed; stop the other workers too.
+					errOnce.Do(func() { firstErr = err })
+					cancel()
+				}
+				return
+			}
+		}()
 	}
-	return nil
+	wg.Wait()
+	return firstErr
 }
 
 // handleRequest handles one image-processing request.
-// A non-nil error from handleRequest will end request processing.
+// A non-nil error from handleRequest will end request processing. Failures
+// to process a request don't: the request is retried later, or given up on.
+// Once a request is received, it is handled to the end even if ctx is done.
 func (p *processor) handleRequest(ctx context.Context) error {
 	msg, err := p.requestSub.Receive(ctx)
 	if err != nil {
 		// If we can't receive messages, we should stop processing.
 		return err
 	}
+	ctx = context.WithoutCancel(ctx)
 
 	var req OrderRequest
 	if err := json.Unmarshal(msg.Body, &req); err != nil {
 		// We can't unmarshal the message body. That could be due to a bug or
 		// change in the frontend, or maybe some other program is sending
-		// malformed messages.
-
-		// Ack the message, because if we can't unmarshal it then no one else can either.
-		msg.Ack()
-		// Don't terminate processing; maybe this is just one bad message.
-		log.Printf("unmarshaling request: %v", err)
+		// malformed messages. No one else can unmarshal it either, so
+		// don't retry it.
+		p.deadLetter(ctx, msg, fmt.Sprintf("unmarshaling request: %v", err))
+		return nil
+	}
+	if req.ID == "" {
+		p.deadLetter(ctx, msg, "request has no order ID")
 		return nil
 	}
 	log.Printf("received %+v", req)
-	order, err := createOrFindOrder(ctx, p.coll, &req)
-	if err != nil {
+	if !p.startOrder(req.ID) {
+		// Another worker is processing the order, so this request is a
+		// duplicate. That worker acks or retries its own request.
+		log.Printf("order %s is already in progress", req.ID)
+		msg.Ack()
+		return nil
+	}
+	defer p.endOrder(req.ID)
+	order, err := p.createOrFindOrder(ctx, &req)
+	if err != nil && !errors.Is(err, errClaimed) {
 		// There was a problem with the database, perhaps due to the network.
-		// Nack the message; perhaps another processor can succeed.
-		if msg.Nackable() {
-			msg.Nack()
-		}
-		// Assume the database error is permanent: terminate processing.
-		return err
+		// Retry later; perhaps this or another processor can succeed.
+		log.Printf("order %s: %v", req.ID, err)
+		p.retryLater(msg, p.backoff(p.countDBFailure(req.ID)))
+		return nil
+	}
+	p.clearDBFailures(req.ID)
+	if errors.Is(err, errClaimed) {
+		// Another processor is working on the order. Check back when its
+		// lease would expire, in case it dies before finishing.
+		log.Printf("order %s is claimed by another processor", req.ID)
+		p.retryLater(msg, p.leaseDuration)
+		return nil
 	}
 	if order == nil {
 		log.Printf("duplicate finished order %v", req.ID)
@@ -97,41 +172,177 @@ func (p *processor) handleRequest(ctx context.Context) error {
 		return nil
 	}
 	// At this point, order is an unfinished order in the database.
-	// Process it.
-	err = p.processOrder(ctx, order)
+	if order.Attempts > p.maxAttempts {
+		// Processors keep failing to finish the order, perhaps because
+		// the image crashes them. Give up on it.
+		p.failOrder(ctx, msg, order, fmt.Sprintf("gave up after %d attempts", p.maxAttempts))
+		return nil
+	}
+	// Process it, holding the lease until we're done.
+	pctx, release := p.holdLease(ctx, order)
+	err = p.processOrder(pctx, order)
+	if lerr := release(); lerr != nil {
+		// Another processor took over the order, and will finish it.
+		log.Printf("order %s: %v", order.ID, lerr)
+		msg.Ack()
+		return nil
+	}
 	// Any processing errors are saved as notes in the order.
 	if err != nil {
 		order.Note = fmt.Sprintf("processing failed: %v", err)
 		order.OutImage = ""
 	}
-	// Save the finished order to the database.
+	// Save the finished order to the database, and release the lease. Like
+	// the claim, the update fails if another processor has taken over.
 	err = p.coll.Update(ctx, order, docstore.Mods{
-		"OutImage":   order.OutImage,
-		"Note":       order.Note,
-		"FinishTime": time.Now(),
+		"OutImage":    order.OutImage,
+		"Note":        order.Note,
+		"FinishTime":  time.Now(),
+		"LeaseOwner":  nil,
+		"LeaseExpiry": nil,
 	})
+	if gcerrors.Code(err) == gcerrors.FailedPrecondition {
+		log.Printf("order %s: %v", order.ID, errLeaseLost)
+		msg.Ack()
+		return nil
+	}
 	if err != nil {
-		// We couldn't save the order to the database.
-		// Nack the message; perhaps another processor can succeed.
-		if msg.Nackable() {
-			msg.Nack()
-		}
-		// Assume the database error is permanent: terminate processing.
-		return err
+		// We couldn't save the order to the database. Retry later; perhaps
+		// this or another processor can succeed.
+		log.Printf("order %s: saving: %v", order.ID, err)
+		p.retryLater(msg, p.backoff(order.Attempts))
+		return nil
 	}
 	// We've successfully processed the image.
 	msg.Ack()
 	return nil
 }
 
+// startOrder records that a worker is processing the order with the given ID.
+// It reports false if another worker already is.
+func (p *processor) startOrder(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inProgress[id] {
+		return false
+	}
+	if p.inProgress == nil {
+		p.inProgress = make(map[string]bool)
+	}
+	p.inProgress[id] = true
+	return true
+}
+
+// endOrder records that the worker processing the order with the given ID is
+// done with it.
+func (p *processor) endOrder(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inProgress, id)
+}
+
+// countDBFailure records that a request for the order with the given ID failed
+// because of a database error, and returns how many have in a row, counting
+// from 1.
+func (p *processor) countDBFailure(id string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dbFailures == nil {
+		p.dbFailures = make(map[string]int)
+	}
+	p.dbFailures[id]++
+	return p.dbFailures[id]
+}
+
+// clearDBFailures records that a request for the order with the given ID got
+// past the database.
+func (p *processor) clearDBFailures(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.dbFailures, id)
+}
+
+// retryLater arranges for msg to be redelivered after d. If msg can't be
+// nacked, it is redelivered when its ack deadline passes instead.
+func (p *processor) retryLater(msg *pubsub.Message, d time.Duration) {
+	if !msg.Nackable() {
+		return
+	}
+	time.AfterFunc(d, msg.Nack)
+}
+
+// backoff returns how long to wait before retrying after the given attempt,
+// counting from 1.
+func (p *processor) backoff(attempt int) time.Duration {
+	d := p.minBackoff
+	for i := 1; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+// failOrder marks order as failed for the given reason, and sends the request
+// in msg to the dead-letter topic.
+func (p *processor) failOrder(ctx context.Context, msg *pubsub.Message, order *Order, reason string) {
+	err := p.coll.Update(ctx, order, docstore.Mods{
+		"OutImage":    nil,
+		"Note":        "processing failed: " + reason,
+		"Failed":      true,
+		"FinishTime":  time.Now(),
+		"LeaseOwner":  nil,
+		"LeaseExpiry": nil,
+	})
+	if err != nil {
+		log.Printf("order %s: marking failed: %v", order.ID, err)
+		p.retryLater(msg, p.backoff(order.Attempts))
+		return
+	}
+	p.deadLetter(ctx, msg, reason)
+}
+
+// deadLetter sends msg to the dead-letter topic with the reason it was given up
+// on, and acks it.
+func (p *processor) deadLetter(ctx context.Context, msg *pubsub.Message, reason string) {
+	log.Printf("giving up on message %s: %s", msg.LoggableID, reason)
+	if p.deadLetterTopic != nil {
+		err := p.deadLetterTopic.Send(ctx, &pubsub.Message{
+			Body:     msg.Body,
+			Metadata: map[string]string{"reason": reason},
+		})
+		if err != nil {
+			// Keep the message so that it isn't lost.
+			log.Printf("sending message %s to dead-letter topic: %v", msg.LoggableID, err)
+			p.retryLater(msg, p.backoff(p.maxAttempts))
+			return
+		}
+	}
+	msg.Ack()
+}
+
+var (
+	// errClaimed is returned by createOrFindOrder when another processor
+	// holds the lease on the order, or claimed it first.
+	errClaimed = errors.New("order claimed by another processor")
+	// errLeaseLost means that another processor took over an order while
+	// this one was working on it.
+	errLeaseLost = errors.New("lease lost to another processor")
+)
+
 // createOrFindOrder either creates a new order from req (the usual case), or returns an
 // existing unfinished order. It returns a nil *Order if the order exists and is
-// finished, that is, this request message is a duplicate.
-// createOrFindOrder returns a non-nil error only for database problems.
-func createOrFindOrder(ctx context.Context, coll *docstore.Collection, req *OrderRequest) (*Order, error) {
+// finished, that is, this request message is a duplicate. Otherwise, it claims
+// the order for p by taking its lease and counting an attempt at processing it.
+// It fails with errClaimed if another processor holds the lease, or claims the
+// order first.
+// createOrFindOrder returns other errors only for database problems.
+func (p *processor) createOrFindOrder(ctx context.Context, req *OrderRequest) (*Order, error) {
+	now := time.Now()
 	// See if there is already a document for this order.
 	order := &Order{ID: req.ID}
-	err := coll.Get(ctx, order)
+	err := p.coll.Get(ctx, order)
 	if err != nil {
 		if gcerrors.Code(err) != gcerrors.NotFound {
 			return nil, err
@@ -139,20 +350,37 @@ func createOrFindOrder(ctx context.Context, coll *docstore.Collection, req *Orde
 		// Normal case: the order wasn't found, because it hasn't been created
 		// yet. Create it.
 		order = &Order{
-			ID:         req.ID,
-			Email:      req.Email,
-			InImage:    req.InImage,
-			CreateTime: req.CreateTime,
+			ID:          req.ID,
+			Email:       req.Email,
+			InImage:     req.InImage,
+			Operations:  req.Operations,
+			CreateTime:  req.CreateTime,
+			Attempts:    1,
+			LeaseOwner:  p.id,
+			LeaseExpiry: now.Add(p.leaseDuration),
 		}
-		if err := coll.Create(ctx, order); err != nil {
+		if err := p.coll.Create(ctx, order); err != nil {
+			if gcerrors.Code(err) == gcerrors.AlreadyExists {
+				return nil, errClaimed
+			}
 			return nil, err
 		}
 		return order, nil
 	}
 	if order.FinishTime.IsZero() {
-		// The order exists, but was not finished. Either it was abandoned by the processor that
-		// was working on it (probably because the processor died), or it is in progress. Assume
-		// that it was abandoned, and process it.
+		// The order exists, but was not finished. If another processor holds
+		// the lease, it is working on the order. Otherwise the order was
+		// abandoned, probably because the processor working on it died, and
+		// we take it over.
+		if order.LeaseOwner != "" && order.LeaseOwner != p.id {
+			if now.Before(order.LeaseExpiry) {
+				return nil, errClaimed
+			}
+			log.Printf("order %s: taking over from %s, whose lease expired at %v", order.ID, order.LeaseOwner, order.LeaseExpiry)
+		}
+		if err := claimOrder(ctx, p.coll, order, p.id, now.Add(p.leaseDuration)); err != nil {
+			return nil, err
+		}
 		return order, nil
 	}
 	// The order exists and was finished. This is most likely the result of a pubsub redelivery.
@@ -160,8 +388,86 @@ func createOrFindOrder(ctx context.Context, coll *docstore.Collection, req *Orde
 	return nil, nil
 }
 
-// processOrder processes the order request.
+// claimOrder claims an existing order for owner until expiry, and counts an
+// attempt at processing it. The order must have the revision it was read
+// with, so that the claim fails with errClaimed if another processor has
+// changed the order since.
+func claimOrder(ctx context.Context, coll *docstore.Collection, order *Order, owner string, expiry time.Time) error {
+	err := coll.Update(ctx, order, docstore.Mods{
+		"Attempts":    docstore.Increment(1),
+		"LeaseOwner":  owner,
+		"LeaseExpiry": expiry,
+	})
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.FailedPrecondition {
+			return errClaimed
+		}
+		return err
+	}
+	order.Attempts++
+	order.LeaseOwner, order.LeaseExpiry = owner, expiry
+	return nil
+}
+
+// holdLease renews p's lease on order until the returned release function is
+// called. The returned context is canceled if the lease is lost, that is, if
+// another processor takes over the order. release returns errLeaseLost in that
+// case. Otherwise, it updates the order's revision to the last renewal's, so
+// that the order can be saved.
+func (p *processor) holdLease(ctx context.Context, order *Order) (context.Context, func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	// Renew with a copy of the order, so that it can be processed meanwhile.
+	lease := &Order{ID: order.ID, DocstoreRevision: order.DocstoreRevision}
+	var lost error
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(p.leaseDuration / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			err := p.coll.Update(ctx, lease, docstore.Mods{"LeaseExpiry": time.Now().Add(p.leaseDuration)})
+			if gcerrors.Code(err) == gcerrors.FailedPrecondition {
+				lost = errLeaseLost
+				cancel()
+				return
+			}
+			if err != nil {
+				// Try again at the next tick, before the lease expires.
+				log.Printf("order %s: renewing lease: %v", order.ID, err)
+			}
+		}
+	}()
+	return ctx, func() error {
+		close(done)
+		<-stopped
+		cancel()
+		order.DocstoreRevision = lease.DocstoreRevision
+		return lost
+	}
+}
+
+// newProcessorID returns an ID for a processor that is unique among processors
+// sharing a collection, and says where the processor runs.
+func newProcessorID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%08x", host, os.Getpid(), rand.Uint32())
+}
+
+// processOrder processes the order request: it applies the order's operations
+// to the input image and writes the result to the bucket.
 func (p *processor) processOrder(ctx context.Context, order *Order) error {
+	if err := validateOperations(order.Operations); err != nil {
+		return err
+	}
 	// Read the input image from the bucket.
 	r, err := p.bucket.NewReader(ctx, order.InImage, nil)
 	if err != nil {
@@ -173,14 +479,19 @@ func (p *processor) processOrder(ctx context.Context, order *Order) error {
 	if err != nil {
 		return err
 	}
+	img, err = applyOperations(img, order.Operations)
+	if err != nil {
+		return err
+	}
 
-	// Process and write the output image.
-	order.OutImage = fmt.Sprintf("%s-out.png", strings.TrimSuffix(order.InImage, "-in"))
+	// Write the output image.
+	out := outputFormat(order.Operations)
+	order.OutImage = fmt.Sprintf("%s-out.%s", strings.TrimSuffix(order.InImage, "-in"), out.Format)
 	w, err := p.bucket.NewWriter(ctx, order.OutImage, nil)
 	if err != nil {
 		return err
 	}
-	if err := png.Encode(w, img); err != nil {
+	if err := encode(w, img, out); err != nil {
 		w.Close()
 		return err
 	}
@@ -188,9 +499,23 @@ func (p *processor) processOrder(ctx context.Context, order *Order) error {
 		return err
 	}
 
-	// Pretend that the conversion takes some time.
-	time.Sleep(time.Duration(rand.Intn(5)+2) * time.Second)
+	// Pretend that the conversion takes some time. Stop pretending if the
+	// lease is lost.
+	if p.delay != nil {
+		select {
+		case <-time.After(p.delay()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
-	order.Note = fmt.Sprintf("converted from %s to png", format)
+	order.Note = fmt.Sprintf("converted from %s to %s", format, out.Format)
+	if len(order.Operations) > 0 {
+		var ops []string
+		for _, op := range order.Operations {
+			ops = append(ops, op.String())
+		}
+		order.Note += ": " + strings.Join(ops, ", ")
+	}
 	return nil
 }
@@ -15,15 +15,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"gocloud.dev/blob"
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
 	"gocloud.dev/pubsub"
 	_ "gocloud.dev/pubsub/mempubsub"
 )
@@ -55,63 +65,739 @@ func TestHandleRequest(t *testing.T) {
 
 }
 
+func TestHandleRequestRetries(t *testing.T) {
+	f, p, cleanup, err := setup(testConfig("HandleRequestRetries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	p.minBackoff = 10 * time.Millisecond
+
+	// Make every database operation fail.
+	ctx := context.Background()
+	coll, err := docstore.OpenCollection(ctx, "mem://orders-HandleRequestRetries-closed/ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll.Close()
+	p.coll = coll
+
+	body, err := json.Marshal(&OrderRequest{ID: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.requestTopic.Send(ctx, &pubsub.Message{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.handleRequest(ctx); err != nil {
+		t.Fatalf("got %v, want the processor to keep running", err)
+	}
+	// The request is redelivered after the backoff, which doubles each time
+	// the request fails.
+	start := time.Now()
+	if err := p.handleRequest(ctx); err != nil {
+		t.Fatalf("second delivery: got %v, want the processor to keep running", err)
+	}
+	rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	msg, err := p.requestSub.Receive(rctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if got, want := time.Since(start), 2*p.minBackoff; got < want {
+		t.Errorf("redelivered after %v, want at least %v", got, want)
+	}
+	if string(msg.Body) != string(body) {
+		t.Errorf("redelivered %q, want %q", msg.Body, body)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	f, p, cleanup, err := setup(testConfig("DeadLetter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ctx := context.Background()
+	deadLetters, err := pubsub.OpenSubscription(ctx, "mem://dead-letters-DeadLetter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadLetters.Shutdown(ctx)
+
+	// An order that processors have started on as many times as allowed,
+	// without finishing it.
+	stuck := &Order{ID: "stuck", InImage: "stuck-in", Attempts: p.maxAttempts}
+	if err := p.coll.Create(ctx, stuck); err != nil {
+		t.Fatal(err)
+	}
+	stuckReq, err := json.Marshal(&OrderRequest{ID: "stuck", InImage: "stuck-in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noID, err := json.Marshal(&OrderRequest{InImage: "x-in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		body       []byte
+		wantReason string
+	}{
+		{"malformed", []byte("{"), "unmarshaling request: unexpected end of JSON input"},
+		{"no ID", noID, "request has no order ID"},
+		{"too many attempts", stuckReq, "gave up after 3 attempts"},
+	} {
+		if err := f.requestTopic.Send(ctx, &pubsub.Message{Body: test.body}); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.handleRequest(ctx); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		msg, err := deadLetters.Receive(rctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		msg.Ack()
+		if string(msg.Body) != string(test.body) {
+			t.Errorf("%s: got %q on the dead-letter topic, want the original request %q", test.name, msg.Body, test.body)
+		}
+		if got := msg.Metadata["reason"]; got != test.wantReason {
+			t.Errorf("%s: got reason %q, want %q", test.name, got, test.wantReason)
+		}
+	}
+
+	got := &Order{ID: "stuck"}
+	if err := p.coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Failed || got.FinishTime.IsZero() || got.Attempts != p.maxAttempts+1 {
+		t.Errorf("got %+v, want a failed, finished order with %d attempts", got, p.maxAttempts+1)
+	}
+}
+
+func TestRunWorkers(t *testing.T) {
+	conf := testConfig("RunWorkers")
+	conf.workers = 4
+	f, p, cleanup, err := setup(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// Count the orders being processed at once.
+	var mu sync.Mutex
+	var running, maxRunning int
+	p.delay = func() time.Duration {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return 0
+	}
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 8; i++ {
+		req := &OrderRequest{ID: fmt.Sprintf("order%d", i), InImage: fmt.Sprintf("order%d-in", i)}
+		ids = append(ids, req.ID)
+		if err := writeTestImage(ctx, p.bucket, req.InImage); err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Send each request twice, as pubsub may deliver it twice.
+		for j := 0; j < 2; j++ {
+			if err := f.requestTopic.Send(ctx, &pubsub.Message{Body: body}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	rctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() { errc <- p.run(rctx) }()
+	orders := waitForOrders(t, p.coll, ids)
+	cancel()
+	if err := <-errc; err != nil {
+		t.Errorf("run: got %v, want nil after the context is canceled", err)
+	}
+	for _, o := range orders {
+		if o.Attempts != 1 || o.Failed || o.OutImage == "" {
+			t.Errorf("got %+v, want an order processed once", o)
+		}
+	}
+	if maxRunning < 2 {
+		t.Errorf("at most %d orders were processed at once, want more", maxRunning)
+	}
+}
+
+func TestRunDrains(t *testing.T) {
+	f, p, cleanup, err := setup(testConfig("RunDrains"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	p.delay = func() time.Duration {
+		close(started)
+		<-release
+		return 0
+	}
+
+	ctx := context.Background()
+	if err := writeTestImage(ctx, p.bucket, "drain-in"); err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&OrderRequest{ID: "drain", InImage: "drain-in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.requestTopic.Send(ctx, &pubsub.Message{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() { errc <- p.run(rctx) }()
+
+	// Cancel while the order is being processed. run waits for it.
+	<-started
+	cancel()
+	select {
+	case err := <-errc:
+		t.Fatalf("run returned %v before the order in progress finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	order := &Order{ID: "drain"}
+	if err := p.coll.Get(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if order.FinishTime.IsZero() || order.OutImage == "" {
+		t.Errorf("got %+v, want a finished order", order)
+	}
+}
+
+func TestClaimOrder(t *testing.T) {
+	_, p, cleanup, err := setup(testConfig("ClaimOrder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ctx := context.Background()
+	if err := p.coll.Create(ctx, &Order{ID: "x", Attempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Two processors read the order, then both try to claim it.
+	a, b := &Order{ID: "x"}, &Order{ID: "x"}
+	if err := p.coll.Get(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.coll.Get(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Minute).Round(0)
+	if err := claimOrder(ctx, p.coll, a, "a", expiry); err != nil {
+		t.Fatalf("first claim: %v", err)
+	}
+	if err := claimOrder(ctx, p.coll, b, "b", expiry); err != errClaimed {
+		t.Fatalf("second claim: got %v, want %v", err, errClaimed)
+	}
+	got := &Order{ID: "x"}
+	if err := p.coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Attempts != 2 || got.LeaseOwner != "a" || !got.LeaseExpiry.Equal(expiry) {
+		t.Errorf("got %+v, want the order claimed by a", got)
+	}
+	if a.Attempts != 2 || a.LeaseOwner != "a" {
+		t.Errorf("claimed order is %+v, want it updated", a)
+	}
+}
+
+// setupTwoProcessors sets up two processors that share a collection, a bucket
+// and a request topic. Each has its own subscription, so each receives every
+// request, as if pubsub delivered each request twice.
+func setupTwoProcessors(t *testing.T, name string) (*frontend, *processor, *processor) {
+	conf := testConfig(name)
+	var err error
+	conf.bucketURL, err = fileURL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, p1, cleanup1, err := setup(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, p2, cleanup2, err := setup(conf)
+	if err != nil {
+		cleanup1()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cleanup2()
+		cleanup1()
+	})
+	if p1.id == p2.id {
+		t.Fatalf("both processors have ID %s", p1.id)
+	}
+	return f, p1, p2
+}
+
+// fileURL returns the file URL of dir.
+func fileURL(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return "file:///" + strings.TrimPrefix(filepath.ToSlash(abs), "/"), nil
+}
+
+// sendRequest writes a test image for an order with the given ID, and sends
+// a request for the order.
+func sendRequest(t *testing.T, f *frontend, id string) {
+	t.Helper()
+	ctx := context.Background()
+	req := &OrderRequest{ID: id, InImage: id + "-in"}
+	if err := writeTestImage(ctx, f.bucket, req.InImage); err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.requestTopic.Send(ctx, &pubsub.Message{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTwoProcessors(t *testing.T) {
+	f, p1, p2 := setupTwoProcessors(t, "TwoProcessors")
+	// Count the orders processed by both processors together.
+	var mu sync.Mutex
+	processed := 0
+	for _, p := range []*processor{p1, p2} {
+		p.workers = 2
+		p.delay = func() time.Duration {
+			mu.Lock()
+			processed++
+			mu.Unlock()
+			return 20 * time.Millisecond
+		}
+	}
+
+	var ids []string
+	for i := 0; i < 8; i++ {
+		id := fmt.Sprintf("order%d", i)
+		ids = append(ids, id)
+		sendRequest(t, f, id)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 2)
+	go func() { errc <- p1.run(ctx) }()
+	go func() { errc <- p2.run(ctx) }()
+	orders := waitForOrders(t, p1.coll, ids)
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	for _, o := range orders {
+		if o.Attempts != 1 || o.OutImage == "" || o.LeaseOwner != "" {
+			t.Errorf("got %+v, want an order processed once, with its lease released", o)
+		}
+	}
+	if processed != len(ids) {
+		t.Errorf("processed %d orders, want %d", processed, len(ids))
+	}
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	f, p, cleanup, err := setup(testConfig("LeaseTakeover"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	p.leaseDuration = 50 * time.Millisecond
+	processed := 0
+	p.delay = func() time.Duration { processed++; return 0 }
+
+	// One order was abandoned by a processor whose lease expired; another
+	// is being worked on by a processor whose lease is current.
+	ctx := context.Background()
+	for _, o := range []*Order{
+		{ID: "abandoned", InImage: "abandoned-in", Attempts: 1, LeaseOwner: "dead", LeaseExpiry: time.Now().Add(-time.Second)},
+		{ID: "busy", InImage: "busy-in", Attempts: 1, LeaseOwner: "busy", LeaseExpiry: time.Now().Add(time.Hour)},
+	} {
+		if err := p.coll.Create(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+		sendRequest(t, f, o.ID)
+	}
+
+	// The abandoned order is taken over. The busy one is left alone, and
+	// its request is redelivered after the lease duration in case the other
+	// processor dies.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := p.handleRequest(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := &Order{ID: "abandoned"}
+	if err := p.coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.FinishTime.IsZero() || got.Attempts != 2 || got.LeaseOwner != "" {
+		t.Errorf("got %+v, want a finished order processed on the second attempt", got)
+	}
+	got = &Order{ID: "busy"}
+	if err := p.coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.FinishTime.IsZero() || got.Attempts != 1 || got.LeaseOwner != "busy" {
+		t.Errorf("got %+v, want the order untouched", got)
+	}
+	if processed != 1 {
+		t.Errorf("processed %d orders, want 1", processed)
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	msg, err := p.requestSub.Receive(rctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if d := time.Since(start); d < p.leaseDuration {
+		t.Errorf("redelivered after %v, want at least %v", d, p.leaseDuration)
+	}
+	var req OrderRequest
+	if err := json.Unmarshal(msg.Body, &req); err != nil || req.ID != "busy" {
+		t.Errorf("redelivered %s, want the request for the busy order", msg.Body)
+	}
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	f, p1, p2 := setupTwoProcessors(t, "LeaseRenewal")
+	ctx := context.Background()
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	for _, p := range []*processor{p1, p2} {
+		p.leaseDuration = 150 * time.Millisecond
+		p.delay = func() time.Duration {
+			started <- struct{}{}
+			<-release
+			return 0
+		}
+	}
+
+	// holdOrder has p1 start on the order with the given ID, calls during,
+	// and keeps p1 working for several lease durations. Meanwhile, p2
+	// receives the same request.
+	holdOrder := func(id string, during func()) {
+		t.Helper()
+		sendRequest(t, f, id)
+		errc := make(chan error, 1)
+		go func() { errc <- p1.handleRequest(ctx) }()
+		<-started
+		during()
+		time.Sleep(3 * p1.leaseDuration)
+		if err := p2.handleRequest(ctx); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-started:
+			t.Errorf("%s: p2 processed the order while p1 held the lease", id)
+		default:
+		}
+		release <- struct{}{}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// p1 renews its lease, so p2 leaves the order alone.
+	holdOrder("renewed", func() {})
+	got := &Order{ID: "renewed"}
+	if err := p1.coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.FinishTime.IsZero() || got.Attempts != 1 || got.OutImage == "" {
+		t.Errorf("got %+v, want the order finished by p1", got)
+	}
+
+	// If p1 loses its lease anyway, it doesn't save the order over the new
+	// owner's work.
+	holdOrder("stolen", func() {
+		steal := &Order{ID: "stolen"} // no revision, so the update is unconditional
+		err := p1.coll.Update(ctx, steal, docstore.Mods{"LeaseOwner": "thief", "LeaseExpiry": time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	got = &Order{ID: "stolen"}
+	if err := p1.coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.FinishTime.IsZero() || got.LeaseOwner != "thief" {
+		t.Errorf("got %+v, want the order left to the thief", got)
+	}
+}
+
+// waitForOrders waits until the orders with the given IDs are finished, and
+// returns them. It reads the orders one at a time, because memdocstore queries
+// aren't safe to run while the processor updates the orders.
+func waitForOrders(t *testing.T, coll *docstore.Collection, ids []string) []*Order {
+	t.Helper()
+	ctx := context.Background()
+	deadline := time.Now().Add(10 * time.Second)
+	var orders []*Order
+	for _, id := range ids {
+		for {
+			o := &Order{ID: id}
+			err := coll.Get(ctx, o)
+			if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				t.Fatal(err)
+			}
+			if err == nil && !o.FinishTime.IsZero() {
+				orders = append(orders, o)
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("order %s did not finish", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return orders
+}
+
+// writeTestImage writes a small PNG image to key in bucket.
+func writeTestImage(ctx context.Context, bucket *blob.Bucket, key string) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		return err
+	}
+	return bucket.WriteAll(ctx, key, buf.Bytes(), nil)
+}
+
+func TestBackoff(t *testing.T) {
+	p := &processor{minBackoff: time.Second, maxBackoff: 10 * time.Second}
+	for _, test := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	} {
+		if got := p.backoff(test.attempt); got != test.want {
+			t.Errorf("backoff(%d) = %v, want %v", test.attempt, got, test.want)
+		}
+	}
+}
+
 func TestProcessOrder(t *testing.T) {
 	_, p, cleanup, err := setup(testConfig("ProcessOrder"))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer cleanup()
+	p.delay = nil
 
 	ctx := context.Background()
+	// cat1 is a 1200x1199 JPEG.
 	for _, test := range []struct {
-		filename string
-		want     *Order
-		wantErr  bool
+		name       string
+		filename   string
+		ops        []Operation
+		want       *Order
+		wantFormat string
+		wantSize   image.Point
+		wantGray   bool
+		wantErr    bool
 	}{
 		{
-			"cat1",
-			&Order{
-				ID:       "cat1",
-				Email:    "joe@example.com",
-				InImage:  "cat1",
+			name:     "cat1",
+			filename: "cat1",
+			want: &Order{
 				OutImage: "cat1-out.png",
 				Note:     "converted from jpeg to png",
 			},
-			false,
+			wantFormat: "png",
+			wantSize:   image.Pt(1200, 1199),
+		},
+		{
+			name:     "resize",
+			filename: "cat1",
+			ops:      []Operation{{Name: opResize, Width: 300, Height: 100}},
+			want: &Order{
+				OutImage: "resize-out.png",
+				Note:     "converted from jpeg to png: resize 300x100",
+			},
+			wantFormat: "png",
+			wantSize:   image.Pt(300, 100),
+		},
+		{
+			name:     "resize-keep-aspect",
+			filename: "cat1",
+			ops:      []Operation{{Name: opResize, Height: 100}},
+			want: &Order{
+				OutImage: "resize-keep-aspect-out.png",
+				Note:     "converted from jpeg to png: resize 0x100",
+			},
+			wantFormat: "png",
+			wantSize:   image.Pt(100, 100),
+		},
+		{
+			name:     "crop-rotate",
+			filename: "cat1",
+			ops: []Operation{
+				{Name: opCrop, X: 100, Y: 200, Width: 400, Height: 50},
+				{Name: opRotate, Degrees: 90},
+			},
+			want: &Order{
+				OutImage: "crop-rotate-out.png",
+				Note:     "converted from jpeg to png: crop 400x50+100+200, rotate 90",
+			},
+			wantFormat: "png",
+			wantSize:   image.Pt(50, 400),
+		},
+		{
+			name:     "crop-past-edge",
+			filename: "cat1",
+			ops:      []Operation{{Name: opCrop, X: 1100, Y: 1000, Width: 400, Height: 400}},
+			want: &Order{
+				OutImage: "crop-past-edge-out.png",
+				Note:     "converted from jpeg to png: crop 400x400+1100+1000",
+			},
+			wantFormat: "png",
+			wantSize:   image.Pt(100, 199),
 		},
 		{
-			"bad-image",
-			nil,
-			true,
+			name:     "thumbnail-gray-jpeg",
+			filename: "cat1",
+			ops: []Operation{
+				{Name: opThumbnail, Width: 64, Height: 32},
+				{Name: opGrayscale},
+				{Name: opFormat, Format: "jpeg", Quality: 50},
+			},
+			want: &Order{
+				OutImage: "thumbnail-gray-jpeg-out.jpeg",
+				Note:     "converted from jpeg to jpeg: thumbnail 64x32, grayscale, format jpeg quality 50",
+			},
+			wantFormat: "jpeg",
+			wantSize:   image.Pt(32, 32),
+			wantGray:   true,
+		},
+		{
+			name:     "gif",
+			filename: "cat1",
+			ops: []Operation{
+				{Name: opFormat, Format: "gif"},
+				{Name: opThumbnail, Width: 100, Height: 100},
+			},
+			want: &Order{
+				OutImage: "gif-out.gif",
+				Note:     "converted from jpeg to gif: format gif, thumbnail 100x100",
+			},
+			wantFormat: "gif",
+			wantSize:   image.Pt(100, 100),
+		},
+		{
+			name:     "crop-outside",
+			filename: "cat1",
+			ops:      []Operation{{Name: opCrop, X: 2000, Y: 0, Width: 10, Height: 10}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid-operation",
+			filename: "cat1",
+			ops:      []Operation{{Name: opRotate, Degrees: 45}},
+			wantErr:  true,
+		},
+		{
+			name:     "bad-image",
+			filename: "bad-image",
+			wantErr:  true,
 		},
 	} {
-		if err := copyFileToBucket("testdata/"+test.filename, p.bucket); err != nil {
+		if err := copyFileToBucket("testdata/"+test.filename, test.name, p.bucket); err != nil {
 			t.Fatal(err)
 		}
 		got := &Order{
-			ID:      test.filename,
-			Email:   "joe@example.com",
-			InImage: test.filename,
+			ID:         test.name,
+			Email:      "joe@example.com",
+			InImage:    test.name,
+			Operations: test.ops,
 		}
 		err := p.processOrder(ctx, got)
 		if err == nil && test.wantErr {
-			t.Errorf("%s: got nil, want error", test.filename)
+			t.Errorf("%s: got nil, want error", test.name)
+			continue
 		} else if err != nil && !test.wantErr {
-			t.Errorf("%s: got error %v, want nil", test.filename, err)
-		} else if err == nil && !cmp.Equal(got, test.want) {
-			t.Errorf("%s:\ngot  %+v\nwant %+v", test.filename, got, test.want)
+			t.Errorf("%s: got error %v, want nil", test.name, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		want := *test.want
+		want.ID, want.Email, want.InImage, want.Operations = got.ID, got.Email, got.InImage, test.ops
+		if !cmp.Equal(got, &want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", test.name, got, &want)
+		}
+
+		// Check the output image.
+		r, err := p.bucket.NewReader(ctx, got.OutImage, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, format, err := image.Decode(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("%s: decoding output: %v", test.name, err)
+			continue
+		}
+		if format != test.wantFormat {
+			t.Errorf("%s: got format %s, want %s", test.name, format, test.wantFormat)
+		}
+		if size := img.Bounds().Size(); size != test.wantSize {
+			t.Errorf("%s: got size %v, want %v", test.name, size, test.wantSize)
+		}
+		if gray := img.ColorModel() == color.GrayModel; gray != test.wantGray {
+			t.Errorf("%s: got gray %t, want %t", test.name, gray, test.wantGray)
 		}
 	}
 }
 
-func copyFileToBucket(filename string, bucket *blob.Bucket) (err error) {
+// copyFileToBucket copies the named file to key in bucket.
+func copyFileToBucket(filename, key string, bucket *blob.Bucket) (err error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	w, err := bucket.NewWriter(context.Background(), filepath.Base(filename), nil)
+	w, err := bucket.NewWriter(context.Background(), key, nil)
 	if err != nil {
 		return err
 	}
@@ -125,3 +811,35 @@ func copyFileToBucket(filename string, bucket *blob.Bucket) (err error) {
 	_, err = io.Copy(w, f)
 	return err
 }
+
+func TestProcessOrderCanceled(t *testing.T) {
+	_, p, cleanup, err := setup(testConfig("ProcessOrderCanceled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := writeTestImage(ctx, p.bucket, "canceled"); err != nil {
+		t.Fatal(err)
+	}
+	// Lose the lease while pretending to convert the image. The pretend
+	// work would take much longer than the test, so processOrder only
+	// returns if it stops when its context is done.
+	delayed := false
+	p.delay = func() time.Duration {
+		delayed = true
+		cancel()
+		return time.Hour
+	}
+	order := &Order{ID: "canceled", InImage: "canceled"}
+	if err := p.processOrder(ctx, order); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if !delayed {
+		t.Error("processOrder returned before pretending to work")
+	}
+	if order.Note != "" {
+		t.Errorf("order was finished with note %q after its context was canceled", order.Note)
+	}
+}